@@ -4,14 +4,15 @@ go 1.16
 
 require (
 	github.com/andybalholm/brotli v1.0.3 // indirect
-	github.com/fasthttp/router v1.4.0 // indirect
-	github.com/fasthttp/websocket v1.4.3 // indirect
-	github.com/go-pg/pg/v10 v10.10.0 // indirect
-	github.com/google/uuid v1.2.0 // indirect
+	github.com/fasthttp/router v1.4.0
+	github.com/fasthttp/websocket v1.4.3
+	github.com/go-pg/pg/v10 v10.10.0
+	github.com/google/uuid v1.2.0
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/klauspost/compress v1.13.1 // indirect
 	github.com/tmthrgd/go-hex v0.0.0-20190904060850-447a3041c3bc // indirect
-	github.com/valyala/fasthttp v1.27.0 // indirect
-	gopkg.in/ini.v1 v1.62.0 // indirect
+	github.com/valyala/fasthttp v1.27.0
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	gopkg.in/ini.v1 v1.62.0
 	mellium.im/sasl v0.2.1 // indirect
 )
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+// FileChannel records that a file was sent in a channel which doesn't save
+// messages, files of saved messages are found through the messages. There is
+// no message to delete in such channels, the access they give is only removed
+// with the channel.
+type FileChannel struct {
+	FileUuid    string `pg:",pk"`
+	ChannelUuid string `pg:",pk"`
+}
+
+// CanAccessFile tells whether the user uploaded the file or can view a
+// channel where it was sent. Deleting the messages revokes the access in
+// channels which save messages, the access given by channels which don't is
+// kept until the channel is deleted.
+func (server *Server) CanAccessFile(userUuid string, file *File) (bool, error) {
+	if file.UserUuid == userUuid {
+		return true, nil
+	}
+
+	channelUuids, err := server.fileChannelUuids(file.Uuid)
+	if err != nil {
+		return false, err
+	}
+	return server.canViewAny(userUuid, channelUuids), nil
+}
+
+// fileChannelUuids returns the channels where the file was sent, leaving out
+// the deleted messages.
+func (server *Server) fileChannelUuids(fileUuid string) ([]string, error) {
+	files, err := json.Marshal([]string{fileUuid})
+	if err != nil {
+		return nil, err
+	}
+
+	var channelUuids []string
+	_, err = server.Db.Query(&channelUuids, `SELECT channel_uuid FROM messages WHERE files @> ?::jsonb AND deleted IS NULL
+		UNION SELECT channel_uuid FROM file_channels WHERE file_uuid = ?`, string(files), fileUuid)
+	if err != nil {
+		return nil, err
+	}
+	return channelUuids, nil
+}
+
+func (server *Server) canViewAny(userUuid string, channelUuids []string) bool {
+	for _, channelUuid := range channelUuids {
+		channel := server.GetChannelByUuid(channelUuid)
+		if channel != nil && server.CanView(userUuid, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFilesAccess makes sure messages only reference complete files the
+// author can access, uploads in progress only become files once finalized.
+func (server *Server) checkFilesAccess(userUuid string, fileUuids []string) error {
+	distinct := []string{}
+	for _, fileUuid := range fileUuids {
+		if !containsString(distinct, fileUuid) {
+			distinct = append(distinct, fileUuid)
+		}
+	}
+	if len(distinct) == 0 {
+		return nil
+	}
+
+	var files []File
+	err := server.Db.Model(&files).Where("uuid IN (?)", pg.In(distinct)).Column("uuid", "user_uuid").Select()
+	if err != nil {
+		return err
+	}
+	if len(files) != len(distinct) {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown file")
+	}
+	for i := range files {
+		ok, err := server.CanAccessFile(userUuid, &files[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown file %s", files[i].Uuid)
+		}
+	}
+	return nil
+}
+
+// shareFiles gives access to the files sent in a channel which doesn't save
+// messages.
+func (server *Server) shareFiles(channelUuid string, fileUuids []string) error {
+	for _, fileUuid := range fileUuids {
+		_, err := server.Db.Model(&FileChannel{fileUuid, channelUuid}).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (server *Server) fileSignature(fileUuid string, expires int64) string {
+	mac := hmac.New(sha256.New, server.FileUrlSecret)
+	mac.Write([]byte(fileUuid + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignFileUrl returns a path to the file that can be fetched without a token
+// until it expires, for places where headers can't be sent like <img> tags.
+func (server *Server) SignFileUrl(file *File, download bool) string {
+	expires := time.Now().Add(server.FileUrlLifetime).Unix()
+	path := "/files/" + file.Uuid + "/" + url.PathEscape(file.Name)
+	if download {
+		path += "/download"
+	}
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", server.fileSignature(file.Uuid, expires))
+	return path + "?" + query.Encode()
+}
+
+// httpFileViewer checks the credentials of a file request, which are either
+// a signed url or a token. A signed url grants access by itself, otherwise
+// the user must still be checked with CanAccessFile. The response is already
+// written when ok is false.
+func (s *Server) httpFileViewer(ctx *fasthttp.RequestCtx, fileUuid string) (userUuid string, expires time.Time, ok bool) {
+	signature := ctx.QueryArgs().Peek("signature")
+	if len(signature) > 0 {
+		unix, err := strconv.ParseInt(string(ctx.QueryArgs().Peek("expires")), 10, 64)
+		if err != nil || time.Now().Unix() > unix || !hmac.Equal(signature, []byte(s.fileSignature(fileUuid, unix))) {
+			ctx.Error("", fasthttp.StatusForbidden)
+			return "", time.Time{}, false
+		}
+		return "", time.Unix(unix, 0), true
+	}
+
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return "", time.Time{}, false
+	}
+	return userUuid, time.Time{}, true
+}
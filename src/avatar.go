@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"io"
+	"log"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
@@ -14,7 +13,12 @@ type Avatar struct {
 	Uuid     string
 	UserUuid string
 	Type     string
-	Data     []byte
+	Size     int64
+	// Hash is the sha256 of the content.
+	Hash string
+	// Data only holds avatars uploaded before storage backends, until they
+	// are moved by MigrateBlobs.
+	Data []byte
 }
 
 func (s *Server) HttpGetAvatars(ctx *fasthttp.RequestCtx) {
@@ -30,7 +34,7 @@ func (s *Server) HttpGetAvatars(ctx *fasthttp.RequestCtx) {
 	}
 
 	var avatars []Avatar
-	err = s.Db.Model(&avatars).Where("user_uuid = ?", userUuid).Select()
+	err = s.Db.Model(&avatars).Where("user_uuid = ?", userUuid).Column("uuid").Select()
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -91,21 +95,24 @@ func (s *Server) HttpPostAvatar(ctx *fasthttp.RequestCtx) {
 			HttpInternalServerError(ctx, err)
 			return
 		}
-
-		var buf bytes.Buffer
-		io.Copy(&buf, file)
-
-		file.Close()
+		defer file.Close()
 
 		avatar := &Avatar{
 			Uuid:     uuid.New().String(),
 			UserUuid: user.Uuid,
 			Type:     fileType,
-			Data:     buf.Bytes(),
+			Size:     fileHeader.Size,
+		}
+
+		avatar.Hash, err = s.PutBlob("avatars", avatar.Uuid, file, avatar.Size, avatar.Type)
+		if err != nil {
+			HttpInternalServerError(ctx, err)
+			return
 		}
 
 		_, err = s.Db.Model(avatar).Insert()
 		if err != nil {
+			s.Storage.Delete(blobKey("avatars", avatar.Uuid))
 			HttpInternalServerError(ctx, err)
 			return
 		}
@@ -120,9 +127,9 @@ func (s *Server) HttpPostAvatar(ctx *fasthttp.RequestCtx) {
 	}
 
 	go func() {
-		s.Hub.Broadcast <- Packet{
-			Type: PACKET_TYPE_UPDATE_USERS,
-			Data: []User{*user},
+		s.Hub.UsersUpdate <- UsersPacket{
+			PACKET_TYPE_UPDATE_USERS,
+			[]User{*user},
 		}
 	}()
 }
@@ -137,7 +144,7 @@ func (s *Server) HttpGetAvatar(ctx *fasthttp.RequestCtx) {
 	avatar := &Avatar{
 		Uuid: avatarUuid.(string),
 	}
-	err := s.Db.Model(avatar).WherePK().Select()
+	err := s.Db.Model(avatar).WherePK().ExcludeColumn("data").Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusNotFound)
@@ -147,7 +154,14 @@ func (s *Server) HttpGetAvatar(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	ctx.Success(avatar.Type, avatar.Data)
+	// Avatars which weren't hashed yet may not have their size either, they
+	// are sent chunked.
+	size := avatar.Size
+	if len(avatar.Hash) == 0 {
+		size = -1
+	}
+	// Avatars are addressed by uuid and never change.
+	s.httpServeBlob(ctx, "avatars", avatar.Uuid, avatar.Type, size, avatar.Hash, "public, max-age=31536000, immutable")
 }
 
 func (s *Server) HttpDeleteAvatar(ctx *fasthttp.RequestCtx) {
@@ -182,6 +196,11 @@ func (s *Server) HttpDeleteAvatar(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	err = s.Storage.Delete(blobKey("avatars", avatar.Uuid))
+	if err != nil {
+		log.Print(err)
+	}
+
 	if user.AvatarUuid == avatar.Uuid {
 		user.AvatarUuid = ""
 		_, err = s.Db.Model(user).WherePK().Column("avatar_uuid").Update()
@@ -191,9 +210,9 @@ func (s *Server) HttpDeleteAvatar(ctx *fasthttp.RequestCtx) {
 		}
 
 		go func() {
-			s.Hub.Broadcast <- Packet{
-				Type: PACKET_TYPE_UPDATE_USERS,
-				Data: []User{*user},
+			s.Hub.UsersUpdate <- UsersPacket{
+				PACKET_TYPE_UPDATE_USERS,
+				[]User{*user},
 			}
 		}()
 	}
@@ -1,25 +1,380 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"strconv"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
 	"github.com/valyala/fasthttp"
 )
 
 type Channel struct {
-	Uuid         string `json:"uuid"`
-	Name         string `json:"name"`
-	Description  string `json:"description"`
-	Nsfw         bool   `json:"nsfw"`
-	SaveMessages bool   `json:"saveMessages"`
+	Uuid         string      `json:"uuid"`
+	Type         ChannelType `json:"type"`
+	Name         string      `json:"name"`
+	Description  string      `json:"description"`
+	Nsfw         bool        `json:"nsfw"`
+	SaveMessages bool        `json:"saveMessages"`
+	Position     int         `json:"position"`
+	Private      bool        `json:"private"`
+	MemberUuids  []string    `pg:"-" json:"memberUuids,omitempty"`
+}
+
+type ChannelType string
+
+const (
+	CHANNEL_TYPE_TEXT  ChannelType = "text"
+	CHANNEL_TYPE_DM    ChannelType = "dm"
+	CHANNEL_TYPE_GROUP ChannelType = "group"
+)
+
+// IsDirect tells whether the channel is a direct message between users
+// rather than a server channel.
+func (channel *Channel) IsDirect() bool {
+	return channel.Type == CHANNEL_TYPE_DM || channel.Type == CHANNEL_TYPE_GROUP
+}
+
+const (
+	CHANNEL_DESCRIPTION_MAX_LENGTH = 1024
+)
+
+var channelNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// PacketChannelRequest creates or updates a channel, nil fields are left
+// untouched on update.
+type PacketChannelRequest struct {
+	Uuid         string  `json:"uuid"`
+	Name         *string `json:"name"`
+	Description  *string `json:"description"`
+	Nsfw         *bool   `json:"nsfw"`
+	SaveMessages *bool   `json:"saveMessages"`
+	Private      *bool   `json:"private"`
+}
+
+func (p *PacketChannelRequest) Validate() error {
+	if p.Name != nil {
+		name := strings.ToLower(strings.TrimSpace(*p.Name))
+		if !channelNameRegexp.MatchString(name) {
+			return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name must be 1 to 32 lowercase letters, digits, - or _")
+		}
+		p.Name = &name
+	}
+	if p.Description != nil {
+		if !utf8.ValidString(*p.Description) || utf8.RuneCountInString(*p.Description) > CHANNEL_DESCRIPTION_MAX_LENGTH {
+			return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "description can't be longer than %d characters", CHANNEL_DESCRIPTION_MAX_LENGTH)
+		}
+	}
+	return nil
+}
+
+func (p *PacketChannelRequest) apply(channel *Channel) {
+	if p.Name != nil {
+		channel.Name = *p.Name
+	}
+	if p.Description != nil {
+		channel.Description = *p.Description
+	}
+	if p.Nsfw != nil {
+		channel.Nsfw = *p.Nsfw
+	}
+	if p.SaveMessages != nil {
+		channel.SaveMessages = *p.SaveMessages
+	}
+	if p.Private != nil {
+		channel.Private = *p.Private
+	}
+}
+
+func (server *Server) channelNameTaken(name string, exceptUuid string) bool {
+	for _, channel := range server.Channels {
+		if channel.Name == name && channel.Uuid != exceptUuid {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) CreateChannel(actorUuid string, request PacketChannelRequest) (*Channel, error) {
+	err := server.Authorize(actorUuid, "", PERMISSION_MANAGE_CHANNELS)
+	if err != nil {
+		return nil, err
+	}
+	if request.Name == nil {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name is required")
+	}
+	err = request.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	if server.channelNameTaken(*request.Name, "") {
+		return nil, NewPacketError(ERROR_CODE_CONFLICT, "channel %s already exists", *request.Name)
+	}
+
+	channel := &Channel{
+		Uuid:         uuid.New().String(),
+		Type:         CHANNEL_TYPE_TEXT,
+		SaveMessages: true,
+	}
+	for _, c := range server.Channels {
+		if c.Position >= channel.Position {
+			channel.Position = c.Position + 1
+		}
+	}
+	request.apply(channel)
+
+	_, err = server.Db.Model(channel).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	// The creator of a private channel is its first member.
+	if channel.Private {
+		_, err = server.Db.Model(&ChannelMember{channel.Uuid, actorUuid, time.Now()}).Insert()
+		if err != nil {
+			return nil, err
+		}
+		server.Permissions.mux.Lock()
+		server.Permissions.addMember(channel.Uuid, actorUuid)
+		server.Permissions.mux.Unlock()
+	}
+
+	server.Channels = append(server.Channels, channel)
+
+	go func() {
+		server.Hub.ChannelsUpdate <- ChannelsPacket{
+			PACKET_TYPE_ADD_CHANNELS,
+			[]Channel{*channel},
+		}
+	}()
+
+	return channel, nil
+}
+
+func (server *Server) UpdateChannel(actorUuid string, request PacketChannelRequest) (*Channel, error) {
+	if server.GetChannelByUuid(request.Uuid) == nil {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", request.Uuid)
+	}
+	err := server.Authorize(actorUuid, request.Uuid, PERMISSION_MANAGE_CHANNELS)
+	if err != nil {
+		return nil, err
+	}
+	err = request.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	i := server.channelIndex(request.Uuid)
+	if i < 0 {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", request.Uuid)
+	}
+	if request.Name != nil && server.channelNameTaken(*request.Name, request.Uuid) {
+		return nil, NewPacketError(ERROR_CODE_CONFLICT, "channel %s already exists", *request.Name)
+	}
+
+	channel := *server.Channels[i]
+	request.apply(&channel)
+	// Like the creator of a private channel, the actor making it private
+	// becomes a member so as not to lose access to it.
+	madePrivate := channel.Private && !server.Channels[i].Private
+
+	err = server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		_, err := tx.Model(&channel).WherePK().Column("name", "description", "nsfw", "save_messages", "private").Update()
+		if err != nil || !madePrivate {
+			return err
+		}
+		_, err = tx.Model(&ChannelMember{channel.Uuid, actorUuid, time.Now()}).OnConflict("DO NOTHING").Insert()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if madePrivate {
+		server.Permissions.mux.Lock()
+		server.Permissions.addMember(channel.Uuid, actorUuid)
+		server.Permissions.mux.Unlock()
+	}
+
+	server.Channels[i] = &channel
+
+	go func() {
+		server.Hub.ChannelsUpdate <- ChannelsPacket{
+			PACKET_TYPE_UPDATE_CHANNELS,
+			[]Channel{channel},
+		}
+	}()
+
+	return &channel, nil
+}
+
+// ReorderChannels sets the position of every channel, channelUuids must
+// contain each channel exactly once.
+func (server *Server) ReorderChannels(actorUuid string, channelUuids []string) ([]Channel, error) {
+	err := server.Authorize(actorUuid, "", PERMISSION_MANAGE_CHANNELS)
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	if len(channelUuids) != len(server.Channels) {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "every channel must be listed exactly once")
+	}
+
+	channels := make([]*Channel, 0, len(channelUuids))
+	for position, channelUuid := range channelUuids {
+		i := server.channelIndex(channelUuid)
+		if i < 0 {
+			return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+		}
+		for _, c := range channels {
+			if c.Uuid == channelUuid {
+				return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "every channel must be listed exactly once")
+			}
+		}
+		channel := *server.Channels[i]
+		channel.Position = position
+		channels = append(channels, &channel)
+	}
+
+	err = server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		for _, channel := range channels {
+			_, err := tx.Exec("UPDATE channels SET position = ? WHERE uuid = ?", channel.Position, channel.Uuid)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	server.Channels = channels
+
+	result := make([]Channel, 0, len(channels))
+	for _, channel := range channels {
+		result = append(result, *channel)
+	}
+
+	go func() {
+		server.Hub.ChannelsUpdate <- ChannelsPacket{
+			PACKET_TYPE_UPDATE_CHANNELS,
+			result,
+		}
+	}()
+
+	visible := []Channel{}
+	for i := range result {
+		if server.CanView(actorUuid, &result[i]) {
+			visible = append(visible, result[i])
+		}
+	}
+	return visible, nil
+}
+
+// DeleteChannel deletes the channel along with its messages and permission
+// overrides.
+func (server *Server) DeleteChannel(actorUuid string, channelUuid string) error {
+	if server.GetChannelByUuid(channelUuid) == nil {
+		return NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+	}
+	err := server.Authorize(actorUuid, channelUuid, PERMISSION_MANAGE_CHANNELS)
+	if err != nil {
+		return err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	i := server.channelIndex(channelUuid)
+	if i < 0 {
+		return NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+	}
+
+	err = server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		for _, table := range []string{"reactions", "message_revisions"} {
+			_, err := tx.Exec("DELETE FROM ? WHERE message_uuid IN (SELECT uuid FROM messages WHERE channel_uuid = ?)", pg.Ident(table), channelUuid)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("DELETE FROM mentions WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM read_states WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM file_channels WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM messages WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM channel_overrides WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM channel_members WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE users SET channel_uuid = NULL WHERE channel_uuid = ?", channelUuid)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM channels WHERE uuid = ?", channelUuid)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	channels := make([]*Channel, 0, len(server.Channels)-1)
+	channels = append(channels, server.Channels[:i]...)
+	server.Channels = append(channels, server.Channels[i+1:]...)
+
+	server.Permissions.mux.Lock()
+	delete(server.Permissions.overrides, channelUuid)
+	delete(server.Permissions.members, channelUuid)
+	server.Permissions.mux.Unlock()
+
+	go func() {
+		server.Hub.RemoveChannel <- channelUuid
+	}()
+
+	return nil
+}
+
+func (server *Server) channelIndex(channelUuid string) int {
+	for i, channel := range server.Channels {
+		if channel.Uuid == channelUuid {
+			return i
+		}
+	}
+	return -1
 }
 
 func (s *Server) HttpGetChannels(ctx *fasthttp.RequestCtx) {
 	token := string(ctx.Request.Header.Peek("token"))
 
-	_, err := s.GetUserUuidByToken(token)
+	userUuid, err := s.GetUserUuidByToken(token)
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusUnauthorized)
@@ -29,8 +384,7 @@ func (s *Server) HttpGetChannels(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	var channels []Channel
-	err = s.Db.Model(&channels).Select()
+	channels, err := s.LoadUnread(userUuid, s.GetVisibleChannels(userUuid))
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -48,7 +402,7 @@ func (s *Server) HttpGetChannels(ctx *fasthttp.RequestCtx) {
 func (s *Server) HttpGetChannelMessages(ctx *fasthttp.RequestCtx) {
 	token := string(ctx.Request.Header.Peek("token"))
 
-	_, err := s.GetUserUuidByToken(token)
+	userUuid, err := s.GetUserUuidByToken(token)
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusUnauthorized)
@@ -64,43 +418,120 @@ func (s *Server) HttpGetChannelMessages(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	fromMessageUuid := string(ctx.FormValue("from"))
-
-	count := string(ctx.FormValue("count"))
-	if len(count) == 0 {
-		ctx.Error("", fasthttp.StatusBadRequest)
+	if s.GetChannelByUuid(channelUuid.(string)) == nil {
+		ctx.Error("", fasthttp.StatusNotFound)
+		return
+	}
+	err = s.Authorize(userUuid, channelUuid.(string), PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		HttpError(ctx, err)
 		return
 	}
 
-	var messages []Message
-	query := s.Db.Model(&messages).Where("channel_uuid = ?", channelUuid)
-	if len(fromMessageUuid) > 0 {
-		fromMessage := Message{
-			Uuid: fromMessageUuid,
-		}
+	s.httpMessagePage(ctx, userUuid, "channel_uuid = ? AND thread_uuid IS NULL", channelUuid.(string))
+}
 
-		err := s.Db.Model(&fromMessage).WherePK().Select()
-		if err != nil {
+func (s *Server) HttpPostChannel(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
 			HttpInternalServerError(ctx, err)
-			return
 		}
+		return
+	}
+
+	request, err := parseChannelForm(ctx)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
 
-		query.Where("uuid != ? AND date <= ?", fromMessage.Uuid, fromMessage.Date)
+	channel, err := s.CreateChannel(userUuid, request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
 	}
 
-	countInt, err := strconv.Atoi(count)
+	json, err := json.Marshal(channel)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
 	}
 
-	err = query.Order("date DESC").Limit(countInt).Select()
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPatchChannel(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	request, err := parseChannelForm(ctx)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+	request.Uuid = channelUuid.(string)
+
+	channel, err := s.UpdateChannel(userUuid, request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(channel)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
 	}
 
-	json, err := json.Marshal(messages)
+	ctx.Write(json)
+}
+
+func (s *Server) HttpReorderChannels(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuids := []string{}
+	for _, channelUuid := range ctx.PostArgs().PeekMulti("uuid") {
+		channelUuids = append(channelUuids, string(channelUuid))
+	}
+
+	channels, err := s.ReorderChannels(userUuid, channelUuids)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(channels)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -108,3 +539,47 @@ func (s *Server) HttpGetChannelMessages(ctx *fasthttp.RequestCtx) {
 
 	ctx.Write(json)
 }
+
+func (s *Server) HttpDeleteChannel(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.DeleteChannel(userUuid, channelUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+func parseChannelForm(ctx *fasthttp.RequestCtx) (PacketChannelRequest, error) {
+	var err error
+	request := PacketChannelRequest{
+		Name:        HttpOptionalFormValue(ctx, "name"),
+		Description: HttpOptionalFormValue(ctx, "description"),
+	}
+	request.Nsfw, err = HttpOptionalFormBool(ctx, "nsfw")
+	if err != nil {
+		return request, err
+	}
+	request.SaveMessages, err = HttpOptionalFormBool(ctx, "saveMessages")
+	if err != nil {
+		return request, err
+	}
+	request.Private, err = HttpOptionalFormBool(ctx, "private")
+	return request, err
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fasthttp/websocket"
@@ -11,24 +10,53 @@ import (
 )
 
 type Client struct {
-	Conn    *websocket.Conn
-	SendMux sync.Mutex
-	Hub     *Hub
-	User    *User
+	Conn  *websocket.Conn
+	Hub   *Hub
+	User  *User
+	Token string
+	Queue *PacketQueue
+	// Idle is set when the client reports inactivity, it is only accessed by
+	// the hub goroutine.
+	Idle bool
+	// SessionId identifies the client across reconnections, it is only
+	// accessed by the hub goroutine once registered.
+	SessionId string
+	// resumeSeq is the last event received before reconnecting when resuming
+	// is set.
+	resuming  bool
+	resumeSeq uint64
+}
+
+func NewClient(conn *websocket.Conn, hub *Hub, user *User, token string, sessionId string) *Client {
+	config := hub.Server.WebSocket
+	return &Client{
+		Conn:      conn,
+		Hub:       hub,
+		User:      user,
+		Token:     token,
+		Queue:     NewPacketQueue(config.SendQueueSize, config.OverflowPolicy),
+		SessionId: sessionId,
+	}
 }
 
 func (client *Client) Goroutine() {
+	done := make(chan struct{})
 	defer func() {
-		client.Hub.Broadcast <- Packet{
-			Type: PACKET_TYPE_OFFLINE_USERS,
-			Data: []string{client.User.Uuid},
-		}
+		close(done)
+
 		client.Hub.Unregister <- client
 		client.Conn.Close()
-
-		client.User.Online = false
-		client.Hub.Server.Db.Model(client.User).WherePK().Column("online").Update()
 	}()
+
+	config := client.Hub.Server.WebSocket
+	client.Conn.SetReadLimit(config.MaxMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		return client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
+	go client.WriteGoroutine(done)
+
 	for {
 		_, message, err := client.Conn.ReadMessage()
 		if err != nil {
@@ -37,6 +65,8 @@ func (client *Client) Goroutine() {
 			}
 			break
 		}
+		client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+
 		err = client.ParseMessage(message)
 		if err != nil {
 			log.Println("client.ParseMessage:", err)
@@ -44,19 +74,112 @@ func (client *Client) Goroutine() {
 	}
 }
 
+// WriteGoroutine writes queued packets and pings the client until done is
+// closed. A client that stops answering misses its read deadline, which ends
+// Goroutine and goes through the usual unregister path.
+func (client *Client) WriteGoroutine(done chan struct{}) {
+	config := client.Hub.Server.WebSocket
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-client.Queue.Notify:
+			for _, packet := range client.Queue.PopAll() {
+				client.Conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+				err := client.Conn.WriteJSON(packet)
+				if err != nil {
+					client.Conn.Close()
+					return
+				}
+			}
+		case <-ticker.C:
+			err := client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.WriteWait))
+			if err != nil {
+				client.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// SendPacket queues the packet for WriteGoroutine without blocking, a client
+// whose queue overflows is disconnected.
 func (client *Client) SendPacket(packet Packet) {
-	client.SendMux.Lock()
-	defer client.SendMux.Unlock()
-	client.Conn.WriteJSON(packet)
+	dropped, ok := client.Queue.Push(packet)
+	if dropped > 0 {
+		atomic.AddInt64(&client.Hub.Metrics.DroppedPackets, int64(dropped))
+	}
+	if !ok {
+		atomic.AddInt64(&client.Hub.Metrics.OverflowDisconnects, 1)
+		log.Println(client.Conn.RemoteAddr(), "WS", "send queue overflow, disconnecting", client.User.Login)
+		// Closing makes the pending read fail so the client gets cleaned up.
+		client.Conn.Close()
+	}
+}
+
+func (client *Client) SendError(packet *RawPacket, err error) {
+	packetError, ok := err.(*PacketError)
+	if !ok {
+		packetError = NewPacketError(ERROR_CODE_INTERNAL, "internal server error")
+	}
+	if packet != nil {
+		packetError.Type = packet.Type
+		packetError.Id = packet.Id
+	}
+	client.SendPacket(Packet{
+		Type: PACKET_TYPE_ERROR,
+		Id:   packetError.Id,
+		Data: packetError,
+	})
+}
+
+func (client *Client) SendAck(packet *RawPacket, data interface{}) {
+	client.SendPacket(Packet{
+		Type: PACKET_TYPE_ACK,
+		Id:   packet.Id,
+		Data: PacketAck{
+			packet.Type,
+			packet.Id,
+			data,
+		},
+	})
 }
 
 func (client *Client) ParseMessage(message []byte) error {
-	var packet Packet
-	err := json.Unmarshal(message, &packet)
+	packet, err := ParsePacketJson(message)
+	if err != nil {
+		client.SendError(nil, NewPacketError(ERROR_CODE_INVALID_JSON, err.Error()))
+		return err
+	}
+
+	if len(packet.Id) > PACKET_MAX_ID_LEN {
+		packet.Id = packet.Id[:PACKET_MAX_ID_LEN]
+		err = NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "id can't be longer than %d characters", PACKET_MAX_ID_LEN)
+	} else {
+		var ack interface{}
+		ack, err = client.HandlePacket(packet, message)
+		if err == nil && len(packet.Id) > 0 {
+			client.SendAck(packet, ack)
+		}
+	}
 	if err != nil {
+		client.SendError(packet, err)
 		return err
 	}
 
+	if packet.Type != PACKET_TYPE_TYPING {
+		log.Println(client.Conn.RemoteAddr(), "WS", packet.Type)
+	}
+
+	return nil
+}
+
+// HandlePacket processes a client packet and returns the data acknowledging
+// it, if any.
+func (client *Client) HandlePacket(packet *RawPacket, message []byte) (interface{}, error) {
 	switch packet.Type {
 	case PACKET_TYPE_ONLINE_USERS:
 		client.Hub.Message <- ClientMessage{
@@ -64,91 +187,424 @@ func (client *Client) ParseMessage(message []byte) error {
 			message,
 		}
 	case PACKET_TYPE_MESSAGE:
-		recvMsg := packet.Data.(map[string]interface{})
-		files := []string{}
-		for _, file := range recvMsg["files"].([]interface{}) {
-			files = append(files, file.(string))
+		var recvMsg PacketMessageRequest
+		err := packet.DecodeData(&recvMsg)
+		if err != nil {
+			return nil, err
+		}
+		err = recvMsg.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if recvMsg.Files == nil {
+			recvMsg.Files = []string{}
+		}
+
+		channel := client.Hub.Server.GetChannelByUuid(recvMsg.ChannelUuid)
+		if channel == nil {
+			return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", recvMsg.ChannelUuid)
+		}
+		required := PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES
+		if len(recvMsg.Files) > 0 {
+			required |= PERMISSION_UPLOAD_FILES
 		}
+		err = client.Hub.Server.Authorize(client.User.Uuid, channel.Uuid, required)
+		if err != nil {
+			return nil, err
+		}
+		err = client.Hub.Server.checkFilesAccess(client.User.Uuid, recvMsg.Files)
+		if err != nil {
+			return nil, err
+		}
+
+		nonces := client.Hub.Server.MessageNonces
+		if len(packet.Id) > 0 {
+			if msg := nonces.Get(client.User.Uuid, packet.Id); msg != nil {
+				return msg, nil
+			}
+		}
+
+		if (len(recvMsg.ReplyToUuid) > 0 || len(recvMsg.ThreadUuid) > 0) && !channel.SaveMessages {
+			return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "can't reply in a channel which doesn't save messages")
+		}
+		if len(recvMsg.ThreadUuid) > 0 {
+			_, err = client.Hub.Server.GetThreadRoot(channel.Uuid, recvMsg.ThreadUuid)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var quote *MessageQuote
+		if len(recvMsg.ReplyToUuid) > 0 {
+			quote, err = client.Hub.Server.GetMessageQuote(channel.Uuid, recvMsg.ReplyToUuid)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		msg := &Message{
-			uuid.New().String(),
-			recvMsg["channelUuid"].(string),
-			client.User.Uuid,
-			time.Now(),
-			time.Time{},
-			recvMsg["content"].(string),
-			files,
-		}
-
-		channel := client.Hub.Server.GetChannelByUuid(recvMsg["channelUuid"].(string))
-		if channel != nil {
-			if channel.SaveMessages {
-				_, err := client.Hub.Server.Db.Model(msg).Insert()
+			Uuid:        uuid.New().String(),
+			ChannelUuid: channel.Uuid,
+			UserUuid:    client.User.Uuid,
+			Date:        time.Now(),
+			Content:     recvMsg.Content,
+			Files:       recvMsg.Files,
+			Nonce:       packet.Id,
+			ReplyToUuid: recvMsg.ReplyToUuid,
+			ReplyTo:     quote,
+			ThreadUuid:  recvMsg.ThreadUuid,
+		}
+
+		if channel.SaveMessages {
+			r, err := client.Hub.Server.Db.Model(msg).OnConflict("DO NOTHING").Insert()
+			if err != nil {
+				return nil, err
+			}
+
+			// The nonce was already used by a message persisted before the
+			// cache forgot about it, acknowledge that one instead unless it
+			// was deleted since.
+			if r.RowsAffected() == 0 {
+				existing := &Message{}
+				err = client.Hub.Server.Db.Model(existing).Where("user_uuid = ?", client.User.Uuid).Where("nonce = ?", packet.Id).AllWithDeleted().Select()
 				if err != nil {
-					return err
+					return nil, err
+				}
+				if existing.Deleted != nil {
+					return nil, NewPacketError(ERROR_CODE_CONFLICT, "message %s sent with this id was deleted", existing.Uuid)
 				}
+				return existing, nil
 			}
+		} else if len(msg.Files) > 0 {
+			err = client.Hub.Server.shareFiles(channel.Uuid, msg.Files)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-			client.Hub.Broadcast <- Packet{
-				Type: packet.Type,
-				Data: msg,
+		if len(packet.Id) > 0 {
+			nonces.Put(client.User.Uuid, packet.Id, msg)
+		}
+
+		err = client.Hub.Server.broadcastMessage(msg, Packet{
+			Type: packet.Type,
+			Data: msg,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(msg.ThreadUuid) > 0 {
+			err = client.Hub.Server.refreshThread(msg)
+			if err != nil {
+				return nil, err
 			}
 		}
+		client.notifyMentions(msg, channel.SaveMessages)
+
+		return msg, nil
 	case PACKET_TYPE_SET_CHANNEL_UUID:
-		channelUuid := packet.Data.(string)
+		var channelUuid string
+		err := packet.DecodeData(&channelUuid)
+		if err != nil {
+			return nil, err
+		}
+		if client.Hub.Server.GetChannelByUuid(channelUuid) == nil {
+			return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+		}
+		err = client.Hub.Server.Authorize(client.User.Uuid, channelUuid, PERMISSION_VIEW_CHANNEL)
+		if err != nil {
+			return nil, err
+		}
+
 		client.User.ChannelUuid = channelUuid
-		client.Hub.Server.Db.Model(client.User).WherePK().Column("channel_uuid").Update()
+		_, err = client.Hub.Server.Db.Model(client.User).WherePK().Column("channel_uuid").Update()
+		if err != nil {
+			return nil, err
+		}
+
+		client.Hub.Subscribe <- Subscription{
+			client,
+			[]string{channelUuid},
+		}
+	case PACKET_TYPE_SUBSCRIBE, PACKET_TYPE_UNSUBSCRIBE:
+		var channelUuids []string
+		err := packet.DecodeData(&channelUuids)
+		if err != nil {
+			return nil, err
+		}
+		err = validateUuids("channelUuids", channelUuids, PACKET_MAX_UUIDS)
+		if err != nil {
+			return nil, err
+		}
+
+		subscription := Subscription{
+			client,
+			channelUuids,
+		}
+		if packet.Type == PACKET_TYPE_SUBSCRIBE {
+			for _, channelUuid := range channelUuids {
+				if client.Hub.Server.GetChannelByUuid(channelUuid) == nil {
+					return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+				}
+				err = client.Hub.Server.Authorize(client.User.Uuid, channelUuid, PERMISSION_VIEW_CHANNEL)
+				if err != nil {
+					return nil, err
+				}
+			}
+			client.Hub.Subscribe <- subscription
+		} else {
+			client.Hub.Unsubscribe <- subscription
+		}
 	case PACKET_TYPE_TYPING:
-		channelUuid := packet.Data.(string)
-		client.Hub.Broadcast <- Packet{
-			Type: packet.Type,
-			Data: []string{channelUuid, client.User.Uuid},
+		var channelUuid string
+		err := packet.DecodeData(&channelUuid)
+		if err != nil {
+			return nil, err
+		}
+		if client.Hub.Server.GetChannelByUuid(channelUuid) == nil {
+			return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+		}
+		err = client.Hub.Server.Authorize(client.User.Uuid, channelUuid, PERMISSION_VIEW_CHANNEL|PERMISSION_SEND_MESSAGES)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Hub.ChannelBroadcast <- ChannelPacket{
+			channelUuid,
+			Packet{
+				Type: packet.Type,
+				Data: []string{channelUuid, client.User.Uuid},
+			},
 		}
 	case PACKET_TYPE_DELETE_MESSAGE:
-		messageUuid := packet.Data.(string)
+		var messageUuid string
+		err := packet.DecodeData(&messageUuid)
+		if err != nil {
+			return nil, err
+		}
+		err = validateUuid("messageUuid", messageUuid)
+		if err != nil {
+			return nil, err
+		}
 
-		var message Message
-		r, err := client.Hub.Server.Db.Model(&message).Where("uuid = ?", messageUuid).Where("user_uuid = ?", client.User.Uuid).Delete()
+		tombstone, err := client.Hub.Server.DeleteMessage(client.User.Uuid, messageUuid)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if r.RowsAffected() > 0 {
-			client.Hub.Broadcast <- Packet{
-				Type: packet.Type,
-				Data: messageUuid,
+		message := &Message{
+			Uuid:        messageUuid,
+			ChannelUuid: tombstone.ChannelUuid,
+			ThreadUuid:  tombstone.ThreadUuid,
+		}
+		err = client.Hub.Server.broadcastMessage(message, Packet{
+			Type: packet.Type,
+			Data: tombstone,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(message.ThreadUuid) > 0 {
+			err = client.Hub.Server.refreshThread(message)
+			if err != nil {
+				return nil, err
 			}
 		}
+
+		return messageUuid, nil
 	case PACKET_TYPE_EDIT_MESSAGE:
-		recvMsg := packet.Data.(map[string]interface{})
-		messageUuid := recvMsg["messageUuid"].(string)
-		content := recvMsg["content"].(string)
+		var recvMsg PacketEditMessageRequest
+		err := packet.DecodeData(&recvMsg)
+		if err != nil {
+			return nil, err
+		}
+		err = recvMsg.Validate()
+		if err != nil {
+			return nil, err
+		}
 
-		message := &Message{
-			Content: content,
-			Edited:  time.Now(),
+		message, err := client.Hub.Server.EditMessage(client.User.Uuid, recvMsg)
+		if err != nil {
+			return nil, err
+		}
+
+		editMessage := PacketEditMessage{
+			recvMsg.MessageUuid,
+			recvMsg.Content,
+			message.Edited,
 		}
-		r, err := client.Hub.Server.Db.Model(message).Column("content", "edited").Where("uuid = ?", messageUuid).Where("user_uuid = ?", client.User.Uuid).Update()
+		err = client.Hub.Server.broadcastMessage(message, Packet{
+			Type: packet.Type,
+			Data: editMessage,
+		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if r.RowsAffected() > 0 {
-			client.Hub.Broadcast <- Packet{
-				Type: packet.Type,
-				Data: PacketEditMessage{
-					messageUuid,
-					content,
-					message.Edited,
-				},
+		return editMessage, nil
+	case PACKET_TYPE_SET_STATUS:
+		var request PacketSetStatusRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = request.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		client.User.Status = request.Status
+		client.User.CustomStatus = request.CustomStatus
+		client.User.CustomStatusEmoji = request.CustomStatusEmoji
+		client.User.CustomStatusExpires = request.CustomStatusExpires
+		_, err = client.Hub.Server.Db.Model(client.User).WherePK().Column("status", "custom_status", "custom_status_emoji", "custom_status_expires").Update()
+		if err != nil {
+			return nil, err
+		}
+
+		client.Hub.SetStatus <- StatusUpdate{
+			client,
+			request,
+		}
+	case PACKET_TYPE_SET_IDLE:
+		var idle bool
+		err := packet.DecodeData(&idle)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Hub.SetIdle <- IdleUpdate{
+			client,
+			idle,
+		}
+	case PACKET_TYPE_ADD_CHANNELS:
+		var request PacketChannelRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Hub.Server.CreateChannel(client.User.Uuid, request)
+	case PACKET_TYPE_UPDATE_CHANNELS:
+		var request PacketChannelRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = validateUuid("uuid", request.Uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Hub.Server.UpdateChannel(client.User.Uuid, request)
+	case PACKET_TYPE_REORDER_CHANNELS:
+		var channelUuids []string
+		err := packet.DecodeData(&channelUuids)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Hub.Server.ReorderChannels(client.User.Uuid, channelUuids)
+	case PACKET_TYPE_REMOVE_CHANNELS:
+		var channelUuid string
+		err := packet.DecodeData(&channelUuid)
+		if err != nil {
+			return nil, err
+		}
+
+		return channelUuid, client.Hub.Server.DeleteChannel(client.User.Uuid, channelUuid)
+	case PACKET_TYPE_ADD_MEMBERS, PACKET_TYPE_REMOVE_MEMBERS:
+		var request PacketChannelMemberRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = request.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if packet.Type == PACKET_TYPE_ADD_MEMBERS {
+			err = client.Hub.Server.AddChannelMember(client.User.Uuid, request.ChannelUuid, request.UserUuid)
+		} else {
+			err = client.Hub.Server.RemoveChannelMember(client.User.Uuid, request.ChannelUuid, request.UserUuid)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case PACKET_TYPE_ADD_REACTION, PACKET_TYPE_REMOVE_REACTION:
+		var request PacketReactionRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = request.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := client.Hub.Server.SetReaction(client.User.Uuid, request, packet.Type == PACKET_TYPE_ADD_REACTION)
+		if err != nil || message == nil {
+			return nil, err
+		}
+
+		err = client.Hub.Server.broadcastMessage(message, Packet{
+			Type: packet.Type,
+			Data: PacketReaction{
+				message.Uuid,
+				message.ChannelUuid,
+				client.User.Uuid,
+				request.Emoji,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	case PACKET_TYPE_SUBSCRIBE_THREAD, PACKET_TYPE_UNSUBSCRIBE_THREAD:
+		var request PacketThreadRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = request.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		subscription := ThreadSubscription{
+			client,
+			request.ThreadUuid,
+		}
+		if packet.Type == PACKET_TYPE_SUBSCRIBE_THREAD {
+			if client.Hub.Server.GetChannelByUuid(request.ChannelUuid) == nil {
+				return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", request.ChannelUuid)
 			}
+			err = client.Hub.Server.Authorize(client.User.Uuid, request.ChannelUuid, PERMISSION_VIEW_CHANNEL)
+			if err != nil {
+				return nil, err
+			}
+			_, err = client.Hub.Server.GetReadableThreadRoot(request.ChannelUuid, request.ThreadUuid)
+			if err != nil {
+				return nil, err
+			}
+			client.Hub.SubscribeThread <- subscription
+		} else {
+			client.Hub.UnsubscribeThread <- subscription
+		}
+	case PACKET_TYPE_READ:
+		var request PacketReadRequest
+		err := packet.DecodeData(&request)
+		if err != nil {
+			return nil, err
+		}
+		err = request.Validate()
+		if err != nil {
+			return nil, err
 		}
-	default:
-		log.Println("UNKNOWN PACKET TYPE:", packet.Type)
-	}
 
-	if packet.Type != PACKET_TYPE_TYPING {
-		log.Println(client.Conn.RemoteAddr(), "WS", packet.Type)
+		return client.Hub.Server.MarkRead(client.User.Uuid, request)
+	default:
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_PACKET_TYPE, "unknown packet type %d", packet.Type)
 	}
 
-	return nil
+	return nil, nil
 }
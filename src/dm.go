@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	GROUP_MAX_MEMBERS     = 10
+	GROUP_NAME_MAX_LENGTH = 100
+)
+
+// directChannelNamespace derives the uuid of the direct message channel of a
+// pair of users, so that each pair only ever has one.
+var directChannelNamespace = uuid.MustParse("5b8e2f0c-9d4a-4c71-8f3e-6a1d2b7c9e40")
+
+func directChannelUuid(userUuid string, otherUuid string) string {
+	if userUuid > otherUuid {
+		userUuid, otherUuid = otherUuid, userUuid
+	}
+	return uuid.NewSHA1(directChannelNamespace, []byte(userUuid+otherUuid)).String()
+}
+
+func validateGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > GROUP_NAME_MAX_LENGTH {
+		return "", NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name can't be longer than %d characters", GROUP_NAME_MAX_LENGTH)
+	}
+	return name, nil
+}
+
+func (server *Server) checkUsersExist(userUuids []string) error {
+	err := validateUuids("users", userUuids, GROUP_MAX_MEMBERS)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	_, err = server.Db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM users WHERE uuid IN (?)", pg.In(userUuids))
+	if err != nil {
+		return err
+	}
+	if count != len(userUuids) {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown user")
+	}
+	return nil
+}
+
+// OpenDirectChannel returns the direct message channel between both users,
+// creating it the first time.
+func (server *Server) OpenDirectChannel(actorUuid string, userUuid string) (*Channel, error) {
+	if actorUuid == userUuid {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "can't open a direct message with yourself")
+	}
+	err := server.checkUsersExist([]string{userUuid})
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	channelUuid := directChannelUuid(actorUuid, userUuid)
+	if channel, ok := server.DirectChannels[channelUuid]; ok {
+		existing := *channel
+		existing.MemberUuids = server.GetChannelMemberUuids(channelUuid)
+		return &existing, nil
+	}
+
+	channel := &Channel{
+		Uuid:         channelUuid,
+		Type:         CHANNEL_TYPE_DM,
+		SaveMessages: true,
+		Private:      true,
+	}
+	return server.createDirectChannel(channel, []string{actorUuid, userUuid})
+}
+
+// CreateGroupChannel creates a group direct message between the actor and
+// the given users.
+func (server *Server) CreateGroupChannel(actorUuid string, userUuids []string, name string) (*Channel, error) {
+	name, err := validateGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []string{actorUuid}
+	for _, userUuid := range userUuids {
+		duplicate := false
+		for _, member := range members {
+			duplicate = duplicate || member == userUuid
+		}
+		if !duplicate {
+			members = append(members, userUuid)
+		}
+	}
+	if len(members) < 2 {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "a group needs at least one other participant")
+	}
+	if len(members) > GROUP_MAX_MEMBERS {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "group can't have more than %d participants", GROUP_MAX_MEMBERS)
+	}
+	err = server.checkUsersExist(members)
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	channel := &Channel{
+		Uuid:         uuid.New().String(),
+		Type:         CHANNEL_TYPE_GROUP,
+		Name:         name,
+		SaveMessages: true,
+		Private:      true,
+	}
+	return server.createDirectChannel(channel, members)
+}
+
+// createDirectChannel must be called with the channels lock held.
+func (server *Server) createDirectChannel(channel *Channel, userUuids []string) (*Channel, error) {
+	now := time.Now()
+	err := server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		_, err := tx.Model(channel).Insert()
+		if err != nil {
+			return err
+		}
+		for _, userUuid := range userUuids {
+			_, err = tx.Model(&ChannelMember{channel.Uuid, userUuid, now}).Insert()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	server.Permissions.mux.Lock()
+	for _, userUuid := range userUuids {
+		server.Permissions.addMember(channel.Uuid, userUuid)
+	}
+	server.Permissions.mux.Unlock()
+
+	server.DirectChannels[channel.Uuid] = channel
+
+	created := *channel
+	created.MemberUuids = userUuids
+
+	go func() {
+		server.Hub.UserBroadcast <- UserPacket{
+			userUuids,
+			Packet{
+				Type: PACKET_TYPE_ADD_CHANNELS,
+				Data: []Channel{created},
+			},
+		}
+	}()
+
+	return &created, nil
+}
+
+// GetDirectChannels returns the direct message channels of the user along
+// with their participants.
+func (server *Server) GetDirectChannels(userUuid string) []Channel {
+	server.ChannelsMux.RLock()
+	defer server.ChannelsMux.RUnlock()
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+
+	channels := []Channel{}
+	for channelUuid, channel := range server.DirectChannels {
+		members := server.Permissions.members[channelUuid]
+		if !members[userUuid] {
+			continue
+		}
+		direct := *channel
+		for memberUuid := range members {
+			direct.MemberUuids = append(direct.MemberUuids, memberUuid)
+		}
+		channels = append(channels, direct)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Uuid < channels[j].Uuid
+	})
+	return channels
+}
+
+func (server *Server) RenameGroupChannel(actorUuid string, channelUuid string, name string) (*Channel, error) {
+	name, err := validateGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	server.ChannelsMux.Lock()
+	defer server.ChannelsMux.Unlock()
+
+	current, ok := server.DirectChannels[channelUuid]
+	if !ok || current.Type != CHANNEL_TYPE_GROUP {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+	}
+	if !server.CanView(actorUuid, current) {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+	}
+
+	channel := *current
+	channel.Name = name
+	_, err = server.Db.Model(&channel).WherePK().Column("name").Update()
+	if err != nil {
+		return nil, err
+	}
+	server.DirectChannels[channelUuid] = &channel
+
+	go func() {
+		server.Hub.ChannelBroadcast <- ChannelPacket{
+			channelUuid,
+			Packet{
+				Type: PACKET_TYPE_UPDATE_CHANNELS,
+				Data: []Channel{channel},
+			},
+		}
+	}()
+
+	return &channel, nil
+}
+
+func (s *Server) HttpGetDirectChannels(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channels, err := s.LoadUnread(userUuid, s.GetDirectChannels(userUuid))
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(channels)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+// HttpPostDirectChannel opens the direct message with a single user, or
+// creates a group when several users or a name are given.
+func (s *Server) HttpPostDirectChannel(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	userUuids := []string{}
+	for _, u := range ctx.PostArgs().PeekMulti("user") {
+		userUuids = append(userUuids, string(u))
+	}
+	name := HttpOptionalFormValue(ctx, "name")
+
+	var channel *Channel
+	if len(userUuids) == 1 && name == nil {
+		channel, err = s.OpenDirectChannel(userUuid, userUuids[0])
+	} else {
+		if name == nil {
+			name = new(string)
+		}
+		channel, err = s.CreateGroupChannel(userUuid, userUuids, *name)
+	}
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(channel)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPatchDirectChannel(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	channel, err := s.RenameGroupChannel(userUuid, channelUuid.(string), string(ctx.FormValue("name")))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(channel)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
@@ -18,9 +19,16 @@ type File struct {
 	Name     string
 	Type     string
 	Size     int64
-	Data     []byte
+	// Hash is the sha256 of the content.
+	Hash string
+	// Data only holds files uploaded before storage backends, until they are
+	// moved by MigrateBlobs.
+	Data []byte
 }
 
+// HttpPostFile uploads a whole file in a single multipart request, which is
+// buffered in memory and therefore limited to the request body size. Bigger
+// files are sent in chunks to /uploads.
 func (s *Server) HttpPostFile(ctx *fasthttp.RequestCtx) {
 	token := string(ctx.Request.Header.Peek("token"))
 
@@ -34,12 +42,27 @@ func (s *Server) HttpPostFile(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	err = s.Authorize(userUuid, "", PERMISSION_UPLOAD_FILES)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
 	fileHeader, err := ctx.FormFile("file")
 	if err != nil {
 		ctx.Error("", fasthttp.StatusBadRequest)
 		return
 	}
 
+	limit := s.MaxFileSize
+	if s.MaxBodySize < limit {
+		limit = s.MaxBodySize
+	}
+	if fileHeader.Size > limit {
+		HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "file can't be larger than %d bytes, bigger files must be sent in chunks to /uploads", limit))
+		return
+	}
+
 	fileType := fileHeader.Header.Get("Content-Type")
 
 	fileM, err := fileHeader.Open()
@@ -47,11 +70,7 @@ func (s *Server) HttpPostFile(ctx *fasthttp.RequestCtx) {
 		HttpInternalServerError(ctx, err)
 		return
 	}
-
-	var buf bytes.Buffer
-	io.Copy(&buf, fileM)
-
-	fileM.Close()
+	defer fileM.Close()
 
 	file := &File{
 		Uuid:     uuid.New().String(),
@@ -59,47 +78,27 @@ func (s *Server) HttpPostFile(ctx *fasthttp.RequestCtx) {
 		Name:     fileHeader.Filename,
 		Type:     fileType,
 		Size:     fileHeader.Size,
-		Data:     buf.Bytes(),
 	}
 
-	_, err = s.Db.Model(file).Insert()
+	file.Hash, err = s.PutBlob("files", file.Uuid, fileM, file.Size, file.Type)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
 	}
 
-	ctx.WriteString(file.Uuid)
-}
-
-func (s *Server) HttpGetFile(ctx *fasthttp.RequestCtx) {
-	fileUuid := ctx.UserValue("uuid")
-	if fileUuid == nil {
-		ctx.Error("", fasthttp.StatusBadRequest)
-		return
-	}
-
-	fileName := ctx.UserValue("name")
-	if fileUuid == nil {
-		ctx.Error("", fasthttp.StatusBadRequest)
-		return
-	}
-
-	decodedFileName, err := url.QueryUnescape(fileName.(string))
+	_, err = s.Db.Model(file).Insert()
 	if err != nil {
+		s.Storage.Delete(blobKey("files", file.Uuid))
 		HttpInternalServerError(ctx, err)
 		return
 	}
 
-	file := &File{
-		Uuid: fileUuid.(string),
-	}
-	err = s.Db.Model(file).WherePK().Where("name = ?", decodedFileName).Select()
-	if err != nil {
-		if err == pg.ErrNoRows {
-			ctx.Error("", fasthttp.StatusNotFound)
-		} else {
-			HttpInternalServerError(ctx, err)
-		}
+	ctx.WriteString(file.Uuid)
+}
+
+func (s *Server) HttpGetFile(ctx *fasthttp.RequestCtx) {
+	file, cacheControl, ok := s.httpAccessFile(ctx)
+	if !ok {
 		return
 	}
 
@@ -108,13 +107,13 @@ func (s *Server) HttpGetFile(ctx *fasthttp.RequestCtx) {
 		fileType = "text/plain"
 	}
 
-	ctx.Success(fileType, file.Data)
+	s.httpServeBlob(ctx, "files", file.Uuid, fileType, file.Size, file.Hash, cacheControl)
 }
 
 func (s *Server) HttpGetFileInfos(ctx *fasthttp.RequestCtx) {
 	token := string(ctx.Request.Header.Peek("token"))
 
-	_, err := s.GetUserUuidByToken(token)
+	userUuid, err := s.GetUserUuidByToken(token)
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusUnauthorized)
@@ -133,7 +132,7 @@ func (s *Server) HttpGetFileInfos(ctx *fasthttp.RequestCtx) {
 	file := &File{
 		Uuid: fileUuid.(string),
 	}
-	err = s.Db.Model(file).WherePK().Column("name", "type", "size").Select()
+	err = s.Db.Model(file).WherePK().Column("uuid", "user_uuid", "name", "type", "size").Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusNotFound)
@@ -143,8 +142,19 @@ func (s *Server) HttpGetFileInfos(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	ok, err := s.CanAccessFile(userUuid, file)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+	if !ok {
+		ctx.Error("", fasthttp.StatusNotFound)
+		return
+	}
+
 	json, err := json.Marshal(map[string]interface{}{
 		"name": file.Name, "type": file.Type, "size": file.Size,
+		"url": s.SignFileUrl(file, false), "downloadUrl": s.SignFileUrl(file, true),
 	})
 	if err != nil {
 		HttpInternalServerError(ctx, err)
@@ -155,43 +165,183 @@ func (s *Server) HttpGetFileInfos(ctx *fasthttp.RequestCtx) {
 }
 
 func (s *Server) HttpDownloadFile(ctx *fasthttp.RequestCtx) {
-	fileUuid := ctx.UserValue("uuid")
-	if fileUuid == nil {
-		ctx.Error("", fasthttp.StatusBadRequest)
+	file, cacheControl, ok := s.httpAccessFile(ctx)
+	if !ok {
 		return
 	}
 
+	ctx.Response.Header.Add("Content-Disposition", "attachment; filename=\""+file.Name+"\"")
+
+	fileType := file.Type
+	if strings.Contains(fileType, "html") {
+		fileType = "text/plain"
+	}
+
+	s.httpServeBlob(ctx, "files", file.Uuid, fileType, file.Size, file.Hash, cacheControl)
+}
+
+// httpAccessFile loads the requested file once the request is allowed to
+// fetch it, along with how long the response can be cached. Files the user
+// can't access are reported as not found.
+func (s *Server) httpAccessFile(ctx *fasthttp.RequestCtx) (*File, string, bool) {
+	fileUuid := ctx.UserValue("uuid")
 	fileName := ctx.UserValue("name")
-	if fileUuid == nil {
+	if fileUuid == nil || fileName == nil {
 		ctx.Error("", fasthttp.StatusBadRequest)
-		return
+		return nil, "", false
+	}
+
+	userUuid, expires, ok := s.httpFileViewer(ctx, fileUuid.(string))
+	if !ok {
+		return nil, "", false
 	}
 
 	decodedFileName, err := url.QueryUnescape(fileName.(string))
 	if err != nil {
 		HttpInternalServerError(ctx, err)
-		return
+		return nil, "", false
 	}
 
 	file := &File{
 		Uuid: fileUuid.(string),
 	}
-	err = s.Db.Model(file).WherePK().Where("name = ?", decodedFileName).Select()
+	err = s.Db.Model(file).WherePK().Where("name = ?", decodedFileName).ExcludeColumn("data").Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusNotFound)
 		} else {
 			HttpInternalServerError(ctx, err)
 		}
+		return nil, "", false
+	}
+
+	// Signed urls stop working once expired, shared caches must not keep
+	// serving them.
+	if !expires.IsZero() {
+		return file, fmt.Sprintf("private, max-age=%d", int64(time.Until(expires).Seconds())), true
+	}
+
+	ok, err = s.CanAccessFile(userUuid, file)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return nil, "", false
+	}
+	if !ok {
+		ctx.Error("", fasthttp.StatusNotFound)
+		return nil, "", false
+	}
+	return file, "private, max-age=31536000, immutable", true
+}
+
+// httpServeBlob streams the blob as the response body, honoring range and
+// conditional requests. size is -1 when it isn't known, hash is empty when
+// the blob wasn't hashed yet, in which case only whole bodies are sent.
+func (s *Server) httpServeBlob(ctx *fasthttp.RequestCtx, table string, uuid string, contentType string, size int64, hash string, cacheControl string) {
+	ctx.Response.Header.Set("Cache-Control", cacheControl)
+	if len(hash) > 0 {
+		etag := `"` + hash + `"`
+		ctx.Response.Header.Set("ETag", etag)
+		if ifNoneMatch := ctx.Request.Header.Peek("If-None-Match"); len(ifNoneMatch) > 0 && etagMatches(string(ifNoneMatch), etag) {
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+			return
+		}
+	}
+
+	offset, length := int64(0), size
+	rangeHeader := ctx.Request.Header.Peek("Range")
+	if size >= 0 && len(hash) > 0 {
+		ctx.Response.Header.Set("Accept-Ranges", "bytes")
+		// A range of a different version than the one the client has would
+		// corrupt it, If-Range dates aren't supported as there is none.
+		ifRange := ctx.Request.Header.Peek("If-Range")
+		if len(rangeHeader) > 0 && (len(ifRange) == 0 || string(ifRange) == `"`+hash+`"`) {
+			start, end, ok := parseByteRange(string(rangeHeader), size)
+			if !ok {
+				ctx.Error("", fasthttp.StatusRequestedRangeNotSatisfiable)
+				ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				return
+			}
+			if start >= 0 {
+				offset, length = start, end-start+1
+				ctx.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+				ctx.SetStatusCode(fasthttp.StatusPartialContent)
+			}
+		}
+	}
+
+	blob, err := s.OpenBlob(table, uuid, offset, length)
+	if err != nil {
+		if err == ErrBlobNotFound {
+			ctx.Error("", fasthttp.StatusNotFound)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
 		return
 	}
 
-	ctx.Response.Header.Add("Content-Disposition", "attachment; filename=\""+file.Name+"\"")
+	ctx.SetContentType(contentType)
+	ctx.SetBodyStream(blob, int(length))
+}
 
-	fileType := file.Type
-	if strings.Contains(fileType, "html") {
-		fileType = "text/plain"
+// etagMatches tells whether an If-None-Match header matches the etag, using
+// the weak comparison it calls for.
+func etagMatches(header string, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == "*" || value == etag {
+			return true
+		}
 	}
+	return false
+}
 
-	ctx.Success(fileType, file.Data)
+// parseByteRange parses a Range header for a blob of the given size into the
+// first and last byte to send. start is -1 when the whole blob must be sent,
+// which is the case for multiple ranges. ok is false when the range can't be
+// satisfied.
+func parseByteRange(header string, size int64) (start int64, end int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return -1, -1, true
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return -1, -1, true
+	}
+	first, last := spec[:dash], spec[dash+1:]
+
+	var err error
+	if len(first) == 0 {
+		// bytes=-n is the last n bytes.
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return -1, -1, true
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return -1, -1, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if len(last) > 0 {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return -1, -1, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
 }
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	cases := []struct {
+		header string
+		size   int64
+		start  int64
+		end    int64
+		ok     bool
+	}{
+		{"bytes=0-4", 10, 0, 4, true},
+		{"bytes=3-100", 10, 3, 9, true},
+		{"bytes=9-9", 10, 9, 9, true},
+		// Open-ended ranges go to the last byte.
+		{"bytes=5-", 10, 5, 9, true},
+		// Suffix ranges are the last bytes, all of them when longer.
+		{"bytes=-3", 10, 7, 9, true},
+		{"bytes=-20", 10, 0, 9, true},
+		{"bytes=-0", 10, 0, 0, false},
+		{"bytes=-1", 0, 0, 0, false},
+		// Ranges starting past the end can't be satisfied.
+		{"bytes=10-", 10, 0, 0, false},
+		{"bytes=12-15", 10, 0, 0, false},
+		{"bytes=0-", 0, 0, 0, false},
+		// Multiple ranges and malformed headers get the whole blob.
+		{"bytes=0-1,4-5", 10, -1, -1, true},
+		{"items=0-4", 10, -1, -1, true},
+		{"bytes=5-2", 10, -1, -1, true},
+		{"bytes=abc", 10, -1, -1, true},
+		{"bytes=a-", 10, -1, -1, true},
+		{"bytes=-a", 10, -1, -1, true},
+	}
+	for _, c := range cases {
+		start, end, ok := parseByteRange(c.header, c.size)
+		if start != c.start || end != c.end || ok != c.ok {
+			t.Errorf("parseByteRange(%q, %d) = %d, %d, %v, want %d, %d, %v", c.header, c.size, start, end, ok, c.start, c.end, c.ok)
+		}
+	}
+}
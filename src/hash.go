@@ -1,16 +1,215 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func hashPassword(password string) string {
+// PasswordHasher hashes passwords into a self-describing encoded string and
+// verifies passwords against hashes it recognizes.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	Match(encoded string) bool
+	NeedsRehash(encoded string) bool
+}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+func NewPasswordHasher(name string) (PasswordHasher, error) {
+	switch name {
+	case "", "argon2id":
+		return &Argon2idHasher{
+			Memory:  64 * 1024,
+			Time:    1,
+			Threads: 4,
+			KeyLen:  32,
+			SaltLen: 16,
+		}, nil
+	case "bcrypt":
+		return &BcryptHasher{
+			Cost: 12,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %q", name)
+}
+
+// verifyPassword checks password against any supported encoded hash and
+// reports whether it should be rehashed with the current hasher.
+func verifyPassword(current PasswordHasher, password string, encoded string) (bool, bool, error) {
+	hashers := []PasswordHasher{
+		current,
+		&Argon2idHasher{},
+		&BcryptHasher{},
+		&LegacySha256Hasher{},
+	}
+
+	for _, hasher := range hashers {
+		if !hasher.Match(encoded) {
+			continue
+		}
+
+		ok, err := hasher.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+
+		return true, hasher != current || current.NeedsRehash(encoded), nil
+	}
+
+	return false, false, errInvalidPasswordHash
+}
+
+type Argon2idHasher struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	hash, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), hash.salt, hash.time, hash.memory, hash.threads, uint32(len(hash.key)))
+
+	return subtle.ConstantTimeCompare(key, hash.key) == 1, nil
+}
+
+func (h *Argon2idHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	hash, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return hash.memory != h.Memory ||
+		hash.time != h.Time ||
+		hash.threads != h.Threads ||
+		uint32(len(hash.key)) != h.KeyLen ||
+		uint32(len(hash.salt)) != h.SaltLen
+}
+
+func decodeArgon2id(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errInvalidPasswordHash
+	}
+
+	hash := &argon2idHash{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.time, &hash.threads)
+	if err != nil {
+		return nil, errInvalidPasswordHash
+	}
+
+	hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errInvalidPasswordHash
+	}
+	hash.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash.key) == 0 {
+		return nil, errInvalidPasswordHash
+	}
+
+	return hash, nil
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// LegacySha256Hasher only verifies the unsalted hex SHA-256 hashes stored by
+// older versions so they can be upgraded on the next successful login.
+type LegacySha256Hasher struct{}
+
+func (h *LegacySha256Hasher) Hash(password string) (string, error) {
+	return "", errors.New("legacy sha256 password hashes can't be created")
+}
+
+func (h *LegacySha256Hasher) Verify(password string, encoded string) (bool, error) {
 	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(encoded)) == 1, nil
+}
+
+func (h *LegacySha256Hasher) Match(encoded string) bool {
+	if len(encoded) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
 }
 
-func randomHash() string {
-	hash := sha256.Sum256([]byte(randomString(64)))
-	return hex.EncodeToString(hash[:])
+func (h *LegacySha256Hasher) NeedsRehash(encoded string) bool {
+	return true
 }
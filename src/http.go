@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"log"
+	"strconv"
 
 	"github.com/fasthttp/router"
 	"github.com/valyala/fasthttp"
@@ -10,13 +14,46 @@ import (
 func (server *Server) SetupFastHTTPRouter() {
 	server.Router = router.New()
 	server.Router.GET("/configuration", server.HttpGetConfiguration)
+	server.Router.GET("/metrics", server.HttpGetMetrics)
 	server.Router.GET("/ws", server.HttpHandleWebSocket)
 	server.Router.GET("/users", server.HttpGetUsers)
 	server.Router.POST("/users/login", server.HttpUserLogin)
 	server.Router.POST("/users/register", server.HttpUserRegister)
 	server.Router.POST("/users/profile", server.HttpUserProfile)
+	server.Router.POST("/users/logout", server.HttpUserLogout)
+	server.Router.GET("/users/sessions", server.HttpGetSessions)
+	server.Router.DELETE("/users/sessions/{uuid}", server.HttpDeleteSession)
+	server.Router.PUT("/users/{uuid}/roles/{roleUuid}", server.HttpPutUserRole)
+	server.Router.DELETE("/users/{uuid}/roles/{roleUuid}", server.HttpDeleteUserRole)
+	server.Router.POST("/users/{uuid}/kick", server.HttpKickUser)
+	server.Router.POST("/users/{uuid}/ban", server.HttpBanUser)
+	server.Router.DELETE("/users/{uuid}/ban", server.HttpUnbanUser)
+	server.Router.GET("/roles", server.HttpGetRoles)
+	server.Router.POST("/roles", server.HttpPostRole)
+	server.Router.PATCH("/roles/{uuid}", server.HttpPatchRole)
+	server.Router.DELETE("/roles/{uuid}", server.HttpDeleteRole)
 	server.Router.GET("/channels", server.HttpGetChannels)
+	server.Router.POST("/channels", server.HttpPostChannel)
+	server.Router.POST("/channels/order", server.HttpReorderChannels)
+	server.Router.PATCH("/channels/{uuid}", server.HttpPatchChannel)
+	server.Router.DELETE("/channels/{uuid}", server.HttpDeleteChannel)
 	server.Router.GET("/channels/{uuid}/messages", server.HttpGetChannelMessages)
+	server.Router.GET("/channels/{uuid}/messages/deleted", server.HttpGetDeletedMessages)
+	server.Router.GET("/channels/{uuid}/messages/{messageUuid}/thread", server.HttpGetThreadMessages)
+	server.Router.GET("/channels/{uuid}/messages/{messageUuid}/revisions", server.HttpGetMessageRevisions)
+	server.Router.POST("/channels/{uuid}/messages/{messageUuid}/restore", server.HttpRestoreMessage)
+	server.Router.GET("/channels/{uuid}/members", server.HttpGetChannelMembers)
+	server.Router.PUT("/channels/{uuid}/members/{userUuid}", server.HttpPutChannelMember)
+	server.Router.DELETE("/channels/{uuid}/members/{userUuid}", server.HttpDeleteChannelMember)
+	server.Router.GET("/channels/{uuid}/permissions", server.HttpGetChannelOverrides)
+	server.Router.PUT("/channels/{uuid}/permissions/{targetUuid}", server.HttpPutChannelOverride)
+	server.Router.DELETE("/channels/{uuid}/permissions/{targetUuid}", server.HttpDeleteChannelOverride)
+	server.Router.GET("/search", server.HttpSearch)
+	server.Router.GET("/mentions", server.HttpGetMentions)
+	server.Router.POST("/mentions/read", server.HttpMarkMentionsRead)
+	server.Router.GET("/dms", server.HttpGetDirectChannels)
+	server.Router.POST("/dms", server.HttpPostDirectChannel)
+	server.Router.PATCH("/dms/{uuid}", server.HttpPatchDirectChannel)
 	server.Router.POST("/avatars", server.HttpPostAvatar)
 	server.Router.GET("/avatars", server.HttpGetAvatars)
 	server.Router.GET("/avatars/{uuid}", server.HttpGetAvatar)
@@ -25,17 +62,112 @@ func (server *Server) SetupFastHTTPRouter() {
 	server.Router.GET("/files/{uuid}", server.HttpGetFileInfos)
 	server.Router.GET("/files/{uuid}/{name}", server.HttpGetFile)
 	server.Router.GET("/files/{uuid}/{name}/download", server.HttpDownloadFile)
+	server.Router.POST("/uploads", server.HttpPostUpload)
+	server.Router.GET("/uploads/{uuid}", server.HttpGetUpload)
+	server.Router.PATCH("/uploads/{uuid}", server.HttpPatchUpload)
+	server.Router.DELETE("/uploads/{uuid}", server.HttpDeleteUpload)
+	server.Router.POST("/uploads/{uuid}/finalize", server.HttpFinalizeUpload)
 }
 
 func (server *Server) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
-	server.Router.Handler(ctx)
+	if server.limitRequestBody(ctx) {
+		server.Router.Handler(ctx)
+	}
 	ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
 	ctx.Response.Header.Set("Access-Control-Allow-Headers", "*")
 	ctx.Response.Header.Set("Access-Control-Allow-Methods", "*")
 	log.Println(ctx.RemoteAddr(), "HTTP", ctx.Response.StatusCode(), string(ctx.Method()), string(ctx.Path()))
 }
 
+// limitRequestBody applies the request body limit, which fasthttp doesn't
+// enforce on the bodies it streams. Upload chunks are the only bodies allowed
+// to be bigger, they are streamed to storage. It returns false once it
+// replied.
+func (server *Server) limitRequestBody(ctx *fasthttp.RequestCtx) bool {
+	if ctx.IsPatch() && bytes.HasPrefix(ctx.Path(), []byte("/uploads/")) {
+		return true
+	}
+
+	contentLength := ctx.Request.Header.ContentLength()
+	if int64(contentLength) > server.MaxBodySize {
+		ctx.Error("", fasthttp.StatusRequestEntityTooLarge)
+		// The body is left unread, the connection can't be reused.
+		ctx.SetConnectionClose()
+		return false
+	}
+	// Chunked bodies have no length, they are read up to the limit.
+	if contentLength == -1 && ctx.RequestBodyStream() != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(ctx.RequestBodyStream(), server.MaxBodySize+1))
+		if err != nil {
+			ctx.Error("", fasthttp.StatusBadRequest)
+			return false
+		}
+		if int64(len(body)) > server.MaxBodySize {
+			ctx.Error("", fasthttp.StatusRequestEntityTooLarge)
+			ctx.SetConnectionClose()
+			return false
+		}
+		ctx.Request.SetBody(body)
+	}
+	return true
+}
+
 func HttpInternalServerError(ctx *fasthttp.RequestCtx, err error) {
 	log.Print(err)
 	ctx.Error("", fasthttp.StatusInternalServerError)
 }
+
+// HttpError replies with the status matching a PacketError code, or with an
+// internal server error for any other error.
+func HttpError(ctx *fasthttp.RequestCtx, err error) {
+	packetError, ok := err.(*PacketError)
+	if !ok {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	status := fasthttp.StatusBadRequest
+	switch packetError.Code {
+	case ERROR_CODE_NOT_FOUND, ERROR_CODE_UNKNOWN_CHANNEL:
+		status = fasthttp.StatusNotFound
+	case ERROR_CODE_FORBIDDEN:
+		status = fasthttp.StatusForbidden
+	case ERROR_CODE_CONFLICT:
+		status = fasthttp.StatusConflict
+	case ERROR_CODE_INTERNAL:
+		status = fasthttp.StatusInternalServerError
+	}
+	ctx.Error(packetError.Message, status)
+}
+
+// HttpOptionalFormValue returns nil when the key isn't part of the request,
+// unlike ctx.FormValue which can't tell a missing value from an empty one.
+func HttpOptionalFormValue(ctx *fasthttp.RequestCtx, key string) *string {
+	if ctx.QueryArgs().Has(key) {
+		value := string(ctx.QueryArgs().Peek(key))
+		return &value
+	}
+	if ctx.PostArgs().Has(key) {
+		value := string(ctx.PostArgs().Peek(key))
+		return &value
+	}
+	form, err := ctx.MultipartForm()
+	if err == nil {
+		if values, ok := form.Value[key]; ok && len(values) > 0 {
+			return &values[0]
+		}
+	}
+	return nil
+}
+
+func HttpOptionalFormBool(ctx *fasthttp.RequestCtx, key string) (*bool, error) {
+	value := HttpOptionalFormValue(ctx, key)
+	if value == nil {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(*value)
+	if err != nil {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s must be a boolean", key)
+	}
+	return &b, nil
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"time"
 
 	"github.com/fasthttp/websocket"
+	"github.com/google/uuid"
 	"github.com/valyala/fasthttp"
 )
 
@@ -18,6 +19,10 @@ func (s *Server) HttpHandleWebSocket(ctx *fasthttp.RequestCtx) {
 	err := upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
 		defer conn.Close()
 
+		conn.SetReadLimit(s.WebSocket.MaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(s.WebSocket.PongWait))
+		conn.SetWriteDeadline(time.Now().Add(s.WebSocket.WriteWait))
+
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			return
@@ -28,10 +33,16 @@ func (s *Server) HttpHandleWebSocket(ctx *fasthttp.RequestCtx) {
 			return
 		}
 
-		token := fmt.Sprintf("%s", packet.Data)
-		user, err := s.GetUserByToken(token)
+		// The data is either the token or a PacketAuthRequest.
+		var request PacketAuthRequest
+		err = packet.DecodeData(&request.Token)
+		if err != nil {
+			err = packet.DecodeData(&request)
+			if err == nil {
+				err = request.Validate()
+			}
+		}
 		if err != nil {
-			log.Print(err)
 			conn.WriteJSON(Packet{
 				Type: PACKET_TYPE_AUTH,
 				Data: false,
@@ -39,32 +50,36 @@ func (s *Server) HttpHandleWebSocket(ctx *fasthttp.RequestCtx) {
 			return
 		}
 
-		user.Online = true
-		_, err = s.Db.Model(user).WherePK().Column("online").Update()
+		user, err := s.GetUserByToken(request.Token)
 		if err != nil {
 			log.Print(err)
+			conn.WriteJSON(Packet{
+				Type: PACKET_TYPE_AUTH,
+				Data: false,
+			})
+			return
 		}
 
-		client := &Client{
-			Conn: conn,
-			Hub:  s.Hub,
-			User: user,
+		sessionId := request.SessionId
+		if len(sessionId) == 0 {
+			sessionId = uuid.New().String()
 		}
-		s.Hub.Register <- client
+		client := NewClient(conn, s.Hub, user, request.Token, sessionId)
+		client.resuming = len(request.SessionId) > 0
+		client.resumeSeq = request.Seq
 
+		// Sent before registering so that it comes before replayed events.
 		packetAuth := PacketAuth{
 			user.Uuid,
 			user.ChannelUuid,
+			sessionId,
 		}
-		conn.WriteJSON(Packet{
+		client.SendPacket(Packet{
 			Type: PACKET_TYPE_AUTH,
 			Data: packetAuth,
 		})
 
-		s.Hub.Broadcast <- Packet{
-			Type: PACKET_TYPE_ONLINE_USERS,
-			Data: []string{user.Uuid},
-		}
+		s.Hub.Register <- client
 
 		if packet.Type != PACKET_TYPE_TYPING {
 			log.Println(client.Conn.RemoteAddr(), "WS", "authenticated in as", user.Login)
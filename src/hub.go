@@ -3,15 +3,39 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"time"
 )
 
 type Hub struct {
-	Server     *Server
-	Clients    map[*Client]bool
-	Register   chan *Client
-	Unregister chan *Client
-	Message    chan ClientMessage
-	Broadcast  chan Packet
+	Server            *Server
+	Clients           map[*Client]bool
+	Users             map[string]*UserConnections
+	Channels          map[string]map[*Client]bool
+	Threads           map[string]map[*Client]bool
+	Register          chan *Client
+	Unregister        chan *Client
+	Subscribe         chan Subscription
+	Unsubscribe       chan Subscription
+	SubscribeThread   chan ThreadSubscription
+	UnsubscribeThread chan ThreadSubscription
+	Message           chan ClientMessage
+	Broadcast         chan Packet
+	ChannelBroadcast  chan ChannelPacket
+	ThreadBroadcast   chan ThreadPacket
+	ChannelsUpdate    chan ChannelsPacket
+	UsersUpdate       chan UsersPacket
+	UserBroadcast     chan UserPacket
+	Revoke            chan string
+	Disconnect        chan string
+	Stats             chan chan HubStats
+	Metrics           *HubMetrics
+	Presence          *PresenceWrites
+	SetStatus         chan StatusUpdate
+	SetIdle           chan IdleUpdate
+	Presences         chan PresencesRequest
+	RemoveChannel     chan string
+	Events            *EventLog
+	Sessions          map[string]*Session
 }
 
 type ClientMessage struct {
@@ -19,33 +43,375 @@ type ClientMessage struct {
 	message []byte
 }
 
+type Subscription struct {
+	client       *Client
+	channelUuids []string
+}
+
+type ChannelPacket struct {
+	channelUuid string
+	packet      Packet
+}
+
+// ChannelsPacket sends channels to the clients allowed to view them, see
+// broadcastChannels.
+type ChannelsPacket struct {
+	packetType PacketType
+	channels   []Channel
+}
+
+// UsersPacket sends users to every client, with their presence as seen by
+// each client.
+type UsersPacket struct {
+	packetType PacketType
+	users      []User
+}
+
+// UserPacket is sent to every connection of the given users.
+type UserPacket struct {
+	userUuids []string
+	packet    Packet
+}
+
 func NewHub(server *Server) *Hub {
 	return &Hub{
-		Server:     server,
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Clients:    make(map[*Client]bool),
-		Message:    make(chan ClientMessage),
-		Broadcast:  make(chan Packet),
+		Server:            server,
+		Register:          make(chan *Client),
+		Unregister:        make(chan *Client),
+		Subscribe:         make(chan Subscription),
+		Unsubscribe:       make(chan Subscription),
+		Clients:           make(map[*Client]bool),
+		Users:             make(map[string]*UserConnections),
+		Channels:          make(map[string]map[*Client]bool),
+		Threads:           make(map[string]map[*Client]bool),
+		SubscribeThread:   make(chan ThreadSubscription),
+		UnsubscribeThread: make(chan ThreadSubscription),
+		ThreadBroadcast:   make(chan ThreadPacket),
+		Message:           make(chan ClientMessage),
+		Broadcast:         make(chan Packet),
+		ChannelBroadcast:  make(chan ChannelPacket),
+		ChannelsUpdate:    make(chan ChannelsPacket),
+		UsersUpdate:       make(chan UsersPacket),
+		UserBroadcast:     make(chan UserPacket),
+		Revoke:            make(chan string),
+		Disconnect:        make(chan string),
+		Stats:             make(chan chan HubStats),
+		Metrics:           &HubMetrics{},
+		Presence:          NewPresenceWrites(),
+		SetStatus:         make(chan StatusUpdate),
+		SetIdle:           make(chan IdleUpdate),
+		Presences:         make(chan PresencesRequest),
+		RemoveChannel:     make(chan string),
+		Events:            NewEventLog(server.WebSocket.EventLogSize),
+		Sessions:          make(map[string]*Session),
 	}
 }
 
 func (hub *Hub) Goroutine() {
+	presenceTicker := time.NewTicker(PRESENCE_EXPIRY_INTERVAL)
+	defer presenceTicker.Stop()
+
 	for {
 		select {
 		case client := <-hub.Register:
 			hub.Clients[client] = true
+			if len(client.User.ChannelUuid) > 0 {
+				hub.subscribe(client, client.User.ChannelUuid)
+			}
+			if client.resuming {
+				hub.resume(client, client.resumeSeq)
+			}
+
+			connections, ok := hub.Users[client.User.Uuid]
+			if !ok {
+				connections = NewUserConnections(client.User)
+				hub.Users[client.User.Uuid] = connections
+			}
+			connections.clients[client] = true
+			hub.updatePresence(client.User.Uuid, connections.last)
 		case client := <-hub.Unregister:
 			if _, ok := hub.Clients[client]; ok {
 				delete(hub.Clients, client)
+				hub.saveSession(client)
+				for channelUuid := range hub.Channels {
+					hub.unsubscribe(client, channelUuid)
+				}
+				for threadUuid := range hub.Threads {
+					hub.unsubscribeThread(client, threadUuid)
+				}
+
+				connections := hub.Users[client.User.Uuid]
+				delete(connections.clients, client)
+				if len(connections.clients) == 0 {
+					delete(hub.Users, client.User.Uuid)
+				}
+				hub.updatePresence(client.User.Uuid, connections.last)
+			}
+		case subscription := <-hub.Subscribe:
+			if _, ok := hub.Clients[subscription.client]; ok {
+				for _, channelUuid := range subscription.channelUuids {
+					hub.subscribe(subscription.client, channelUuid)
+				}
 			}
+		case subscription := <-hub.Unsubscribe:
+			for _, channelUuid := range subscription.channelUuids {
+				hub.unsubscribe(subscription.client, channelUuid)
+			}
+		case subscription := <-hub.SubscribeThread:
+			if _, ok := hub.Clients[subscription.client]; ok {
+				hub.subscribeThread(subscription.client, subscription.threadUuid)
+			}
+		case subscription := <-hub.UnsubscribeThread:
+			hub.unsubscribeThread(subscription.client, subscription.threadUuid)
+		case threadPacket := <-hub.ThreadBroadcast:
+			hub.broadcastThread(threadPacket)
 		case message := <-hub.Message:
 			hub.ParseClientMessage(message.message, message.client)
 		case packet := <-hub.Broadcast:
+			hub.broadcast(packet)
+		case channelPacket := <-hub.ChannelBroadcast:
+			hub.broadcastChannel(channelPacket.channelUuid, channelPacket.packet)
+		case channelsPacket := <-hub.ChannelsUpdate:
+			hub.broadcastChannels(channelsPacket.packetType, channelsPacket.channels)
+		case usersPacket := <-hub.UsersUpdate:
+			hub.broadcastUsers(usersPacket)
+		case userPacket := <-hub.UserBroadcast:
+			packet := hub.record(eventAudience{userUuids: userPacket.userUuids}, userPacket.packet)
+			for _, userUuid := range userPacket.userUuids {
+				if connections, ok := hub.Users[userUuid]; ok {
+					for c := range connections.clients {
+						c.SendPacket(packet)
+					}
+				}
+			}
+		case token := <-hub.Revoke:
 			for c := range hub.Clients {
-				c.SendPacket(packet)
+				if c.Token == token {
+					c.Conn.Close()
+				}
+			}
+		case userUuid := <-hub.Disconnect:
+			if connections, ok := hub.Users[userUuid]; ok {
+				for c := range connections.clients {
+					c.Conn.Close()
+				}
+			}
+		case stats := <-hub.Stats:
+			stats <- hub.stats()
+		case update := <-hub.SetStatus:
+			if connections, ok := hub.Users[update.client.User.Uuid]; ok {
+				connections.status = update.request.Status
+				connections.customStatus = update.request.CustomStatus
+				connections.customStatusEmoji = update.request.CustomStatusEmoji
+				connections.customStatusExpires = update.request.CustomStatusExpires
+				hub.updatePresence(update.client.User.Uuid, connections.last)
+			}
+		case update := <-hub.SetIdle:
+			if connections, ok := hub.Users[update.client.User.Uuid]; ok {
+				update.client.Idle = update.idle
+				hub.updatePresence(update.client.User.Uuid, connections.last)
+			}
+		case request := <-hub.Presences:
+			presences := make(map[string]Presence)
+			for userUuid, connections := range hub.Users {
+				presence := connections.last.VisibleTo(request.viewerUuid)
+				if presence.IsOnline() {
+					presences[userUuid] = presence
+				}
+			}
+			request.reply <- presences
+		case channelUuid := <-hub.RemoveChannel:
+			delete(hub.Channels, channelUuid)
+			hub.broadcast(Packet{
+				Type: PACKET_TYPE_REMOVE_CHANNELS,
+				Data: []string{channelUuid},
+			})
+		case <-presenceTicker.C:
+			// Picks up custom statuses that expired since the last change.
+			for userUuid, connections := range hub.Users {
+				hub.updatePresence(userUuid, connections.last)
+			}
+			hub.expireSessions(time.Now())
+		}
+	}
+}
+
+func (hub *Hub) broadcast(packet Packet) {
+	packet = hub.record(eventAudience{all: true}, packet)
+	for c := range hub.Clients {
+		c.SendPacket(packet)
+	}
+}
+
+// broadcastChannel sends the packet to the subscribers of the channel,
+// subscribers which lost access to it since they subscribed are dropped.
+// Direct messages go to every connection of their participants instead.
+func (hub *Hub) broadcastChannel(channelUuid string, packet Packet) {
+	packet = hub.record(eventAudience{channelUuid: channelUuid}, packet)
+	channel := hub.Server.GetChannelByUuid(channelUuid)
+	if channel != nil && channel.IsDirect() {
+		for _, userUuid := range hub.Server.GetChannelMemberUuids(channelUuid) {
+			if connections, ok := hub.Users[userUuid]; ok {
+				for c := range connections.clients {
+					c.SendPacket(packet)
+				}
 			}
 		}
+		return
+	}
+
+	for c := range hub.Channels[channelUuid] {
+		if channel == nil || !hub.Server.CanView(c.User.Uuid, channel) {
+			hub.unsubscribe(c, channelUuid)
+			continue
+		}
+		c.SendPacket(packet)
+	}
+}
+
+// broadcastChannels sends each client the channels it can view. Updated
+// channels a client can't view are sent as removed, so that a channel made
+// private disappears for non-members.
+func (hub *Hub) broadcastChannels(packetType PacketType, channels []Channel) {
+	seq := hub.record(eventAudience{channels: &ChannelsPacket{packetType, channels}}, Packet{}).Seq
+	for c := range hub.Clients {
+		for _, packet := range channelsPackets(hub.Server, c.User.Uuid, packetType, channels) {
+			packet.Seq = seq
+			c.SendPacket(packet)
+		}
+	}
+}
+
+// broadcastUsers sends each client the users with the presence it can see,
+// users loaded from the database don't know it.
+func (hub *Hub) broadcastUsers(usersPacket UsersPacket) {
+	seq := hub.record(eventAudience{users: &usersPacket}, Packet{}).Seq
+	for c := range hub.Clients {
+		packet := hub.usersPacket(c.User.Uuid, usersPacket)
+		packet.Seq = seq
+		c.SendPacket(packet)
+	}
+}
+
+func (hub *Hub) usersPacket(viewerUuid string, usersPacket UsersPacket) Packet {
+	users := make([]User, len(usersPacket.users))
+	for i, user := range usersPacket.users {
+		presence := OfflinePresence(user.Uuid)
+		if connections, ok := hub.Users[user.Uuid]; ok {
+			presence = connections.last.VisibleTo(viewerUuid)
+		}
+		user.Online = presence.IsOnline()
+		user.Presence = &presence
+		users[i] = user
+	}
+	return Packet{
+		Type: usersPacket.packetType,
+		Data: users,
+	}
+}
+
+// channelsPackets returns the packets telling the user about the channels it
+// can view, see broadcastChannels.
+func channelsPackets(server *Server, userUuid string, packetType PacketType, channels []Channel) []Packet {
+	visible := []Channel{}
+	hidden := []string{}
+	for i := range channels {
+		if server.CanView(userUuid, &channels[i]) {
+			visible = append(visible, channels[i])
+		} else {
+			hidden = append(hidden, channels[i].Uuid)
+		}
+	}
+
+	packets := []Packet{}
+	if len(visible) > 0 {
+		packets = append(packets, Packet{
+			Type: packetType,
+			Data: visible,
+		})
+	}
+	if len(hidden) > 0 && packetType == PACKET_TYPE_UPDATE_CHANNELS {
+		packets = append(packets, Packet{
+			Type: PACKET_TYPE_REMOVE_CHANNELS,
+			Data: hidden,
+		})
+	}
+	return packets
+}
+
+// updatePresence sends the presence of the user to the clients for which it
+// changed since before, along with ONLINE_USERS and OFFLINE_USERS packets
+// when it appeared or disappeared for them.
+func (hub *Hub) updatePresence(userUuid string, before Presence) {
+	after := OfflinePresence(userUuid)
+	connections, ok := hub.Users[userUuid]
+	if ok {
+		after = connections.Presence(userUuid, time.Now())
+		connections.last = after
+	}
+	if len(before.UserUuid) == 0 {
+		before = OfflinePresence(userUuid)
+	}
+	if before == after {
+		return
+	}
+
+	// The online column is public, invisible users are saved as offline.
+	if online := after.VisibleTo("").IsOnline(); online != before.VisibleTo("").IsOnline() {
+		hub.Presence.Set(userUuid, online)
+	}
+
+	for c := range hub.Clients {
+		visibleBefore := before.VisibleTo(c.User.Uuid)
+		visibleAfter := after.VisibleTo(c.User.Uuid)
+		if visibleBefore == visibleAfter {
+			continue
+		}
+
+		if visibleBefore.IsOnline() != visibleAfter.IsOnline() {
+			packetType := PACKET_TYPE_OFFLINE_USERS
+			if visibleAfter.IsOnline() {
+				packetType = PACKET_TYPE_ONLINE_USERS
+			}
+			c.SendPacket(Packet{
+				Type: packetType,
+				Data: []string{userUuid},
+			})
+		}
+
+		c.SendPacket(Packet{
+			Type: PACKET_TYPE_PRESENCE,
+			Data: []Presence{visibleAfter},
+		})
+	}
+}
+
+func (hub *Hub) subscribe(client *Client, channelUuid string) {
+	subscribers, ok := hub.Channels[channelUuid]
+	if !ok {
+		subscribers = make(map[*Client]bool)
+		hub.Channels[channelUuid] = subscribers
+	}
+	subscribers[client] = true
+}
+
+func (hub *Hub) subscribeThread(client *Client, threadUuid string) {
+	subscribers, ok := hub.Threads[threadUuid]
+	if !ok {
+		subscribers = make(map[*Client]bool)
+		hub.Threads[threadUuid] = subscribers
+	}
+	subscribers[client] = true
+}
+
+func (hub *Hub) unsubscribe(client *Client, channelUuid string) {
+	subscribers, ok := hub.Channels[channelUuid]
+	if !ok {
+		return
+	}
+	delete(subscribers, client)
+	if len(subscribers) == 0 {
+		delete(hub.Channels, channelUuid)
 	}
 }
 
@@ -59,13 +425,22 @@ func (hub *Hub) ParseClientMessage(message []byte, client *Client) error {
 	switch packet.Type {
 	case PACKET_TYPE_ONLINE_USERS:
 		onlineUsers := []string{}
-		for c := range hub.Clients {
-			onlineUsers = append(onlineUsers, c.User.Uuid)
+		presences := []Presence{}
+		for userUuid, connections := range hub.Users {
+			presence := connections.last.VisibleTo(client.User.Uuid)
+			if presence.IsOnline() {
+				onlineUsers = append(onlineUsers, userUuid)
+				presences = append(presences, presence)
+			}
 		}
 		client.SendPacket(Packet{
 			Type: packet.Type,
 			Data: onlineUsers,
 		})
+		client.SendPacket(Packet{
+			Type: PACKET_TYPE_PRESENCE,
+			Data: presences,
+		})
 	default:
 		log.Println("UNKNOWN PACKET TYPE:", packet.Type)
 	}
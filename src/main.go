@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/go-pg/pg/v10/orm"
@@ -51,7 +54,60 @@ func main() {
 		keyFilePath = cfg.Section("ssl").Key("key").String()
 	}
 
-	server := &Server{}
+	server := &Server{
+		MessageNonces: NewNonceCache(),
+	}
+
+	server.PasswordHasher, err = NewPasswordHasher(getConfig(cfg, "PASSWORD_HASHER", "password", "hasher"))
+	panicIf(err)
+
+	server.OwnerLogin = getConfig(cfg, "OWNER", "permissions", "owner")
+	server.MetricsToken = getConfig(cfg, "METRICS_TOKEN", "metrics", "token")
+
+	server.Storage, err = NewStorage(cfg)
+	panicIf(err)
+
+	server.TokenLifetime, err = getDurationConfig(cfg, "TOKEN_LIFETIME", "token", "lifetime", 30*24*time.Hour)
+	panicIf(err)
+
+	server.DeletedMessageRetention, err = getDurationConfig(cfg, "DELETED_MESSAGE_RETENTION", "messages", "deleted_retention", 30*24*time.Hour)
+	panicIf(err)
+
+	server.MaxFileSize, err = getIntConfig(cfg, "FILES_MAX_SIZE", "files", "max_size", 100*1024*1024)
+	panicIf(err)
+	server.FileUrlSecret, err = getFileUrlSecret(cfg)
+	panicIf(err)
+	server.FileUrlLifetime, err = getDurationConfig(cfg, "FILES_URL_LIFETIME", "files", "url_lifetime", 15*time.Minute)
+	panicIf(err)
+	server.MaxBodySize, err = getIntConfig(cfg, "HTTP_MAX_BODY_SIZE", "http", "max_body_size", 10*1024*1024)
+	panicIf(err)
+
+	server.WebSocket.PingInterval, err = getDurationConfig(cfg, "WS_PING_INTERVAL", "websocket", "ping_interval", 30*time.Second)
+	panicIf(err)
+	server.WebSocket.PongWait, err = getDurationConfig(cfg, "WS_PONG_WAIT", "websocket", "pong_wait", 60*time.Second)
+	panicIf(err)
+	server.WebSocket.WriteWait, err = getDurationConfig(cfg, "WS_WRITE_WAIT", "websocket", "write_wait", 10*time.Second)
+	panicIf(err)
+	server.WebSocket.MaxMessageSize, err = getIntConfig(cfg, "WS_MAX_MESSAGE_SIZE", "websocket", "max_message_size", 64*1024)
+	panicIf(err)
+	sendQueueSize, err := getIntConfig(cfg, "WS_SEND_QUEUE_SIZE", "websocket", "send_queue_size", 256)
+	panicIf(err)
+	server.WebSocket.SendQueueSize = int(sendQueueSize)
+	eventLogSize, err := getIntConfig(cfg, "WS_EVENT_LOG_SIZE", "websocket", "event_log_size", 4096)
+	panicIf(err)
+	server.WebSocket.EventLogSize = int(eventLogSize)
+	server.WebSocket.OverflowPolicy, err = ParseOverflowPolicy(getConfig(cfg, "WS_OVERFLOW_POLICY", "websocket", "overflow_policy"))
+	panicIf(err)
+
+	if server.WebSocket.PingInterval >= server.WebSocket.PongWait {
+		log.Fatal("websocket ping_interval must be shorter than pong_wait")
+	}
+	if server.WebSocket.SendQueueSize <= 0 {
+		log.Fatal("websocket send_queue_size must be positive")
+	}
+	if server.WebSocket.EventLogSize < 0 {
+		log.Fatal("websocket event_log_size can't be negative")
+	}
 
 	log.Println("Connecting to postgresql...")
 	server.Db = pg.Connect(&pg.Options{
@@ -72,25 +128,68 @@ func main() {
 		log.Println("Created postgres schema")
 	}
 
+	err = migrateSchema(server.Db)
+	panicIf(err)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate-storage" {
+		log.Print("Moving files and avatars to the storage backend...")
+		err = server.MigrateBlobs()
+		panicIf(err)
+		return
+	}
+
+	err = createBuiltinRoles(server.Db)
+	panicIf(err)
+
+	log.Print("Loading permissions...")
+	err = server.LoadPermissions()
+	panicIf(err)
+	err = server.EnsureOwner(server.OwnerLogin)
+	panicIf(err)
+
 	log.Print("Loading server configuration...")
 	err = server.Db.Model(&server.Configuration).Select()
 	panicIf(err)
 
+	// Nobody can be connected yet, a previous crash may have left users
+	// marked as online.
+	_, err = server.Db.Exec("UPDATE users SET online = false WHERE online")
+	panicIf(err)
+
 	log.Print("Loading channels...")
-	err = server.Db.Model(&server.Channels).Select()
+	var channels []*Channel
+	err = server.Db.Model(&channels).OrderExpr("coalesce(position, 0) ASC, name ASC").Select()
 	panicIf(err)
 
-	log.Printf("Loaded %d channel(s)", len(server.Channels))
+	server.DirectChannels = make(map[string]*Channel)
+	for _, channel := range channels {
+		if channel.IsDirect() {
+			server.DirectChannels[channel.Uuid] = channel
+		} else {
+			server.Channels = append(server.Channels, channel)
+		}
+	}
+
+	log.Printf("Loaded %d channel(s) and %d direct message channel(s)", len(server.Channels), len(server.DirectChannels))
 
 	server.SetupFastHTTPRouter()
 
 	server.Hub = NewHub(server)
 	go server.Hub.Goroutine()
+	go server.Hub.PresenceGoroutine()
+
+	go server.PurgeExpiredTokens()
+	go server.PurgeDeletedMessages()
+	go server.PurgeExpiredUploads()
 
 	fasthttpServer := &fasthttp.Server{
 		Handler:            server.HandleFastHTTP,
 		Name:               server.Configuration.Name,
-		MaxRequestBodySize: 10 * 1024 * 1024 * 1024, // 10 MB
+		MaxRequestBodySize: int(server.MaxBodySize),
+		// Upload chunks are streamed, limitRequestBody enforces the limit on
+		// other requests.
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	}
 
 	if len(certFilePath) > 0 && len(keyFilePath) > 0 {
@@ -104,17 +203,107 @@ func main() {
 	panicIf(err)
 }
 
-func createSchema(db *pg.DB) error {
-	models := []interface{}{
-		(*Configuration)(nil),
-		(*User)(nil),
-		(*Token)(nil),
-		(*Avatar)(nil),
-		(*Channel)(nil),
-		(*Message)(nil),
-		(*File)(nil),
+var models = []interface{}{
+	(*Configuration)(nil),
+	(*User)(nil),
+	(*Token)(nil),
+	(*Avatar)(nil),
+	(*Channel)(nil),
+	(*Message)(nil),
+	(*File)(nil),
+	(*Role)(nil),
+	(*UserRole)(nil),
+	(*ChannelOverride)(nil),
+	(*ChannelMember)(nil),
+	(*Reaction)(nil),
+	(*Mention)(nil),
+	(*ReadState)(nil),
+	(*MessageRevision)(nil),
+	(*Upload)(nil),
+	(*FileChannel)(nil),
+}
+
+// migrations bring databases created by older versions up to date with the
+// models, they must be safe to run on every startup.
+var migrations = []string{
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS uuid text`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created timestamptz`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used timestamptz`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS expires timestamptz`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text`,
+	`UPDATE tokens SET uuid = md5(random()::text || token)::uuid::text WHERE uuid IS NULL`,
+	`UPDATE tokens SET created = now(), last_used = now(), expires = now() + interval '30 days' WHERE expires IS NULL`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS nonce text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_user_uuid_nonce_idx ON messages (user_uuid, nonce)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS status text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS custom_status text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS custom_status_emoji text`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS custom_status_expires timestamptz`,
+	`ALTER TABLE channels ADD COLUMN IF NOT EXISTS position bigint`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS banned boolean`,
+	`ALTER TABLE channels ADD COLUMN IF NOT EXISTS private boolean`,
+	`ALTER TABLE channels ADD COLUMN IF NOT EXISTS type text`,
+	`UPDATE channels SET type = 'text' WHERE type IS NULL`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_uuid text`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_uuid text`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_count bigint`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_last_reply timestamptz`,
+	`CREATE INDEX IF NOT EXISTS messages_thread_uuid_date_idx ON messages (thread_uuid, date)`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(content, ''))) STORED`,
+	`CREATE INDEX IF NOT EXISTS messages_search_idx ON messages USING GIN (search)`,
+	`CREATE INDEX IF NOT EXISTS messages_channel_uuid_date_idx ON messages (channel_uuid, date)`,
+	`CREATE INDEX IF NOT EXISTS mentions_user_uuid_date_idx ON mentions (user_uuid, date)`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted timestamptz`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by text`,
+	`ALTER TABLE avatars ADD COLUMN IF NOT EXISTS size bigint`,
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS hash text`,
+	`ALTER TABLE avatars ADD COLUMN IF NOT EXISTS hash text`,
+	`CREATE INDEX IF NOT EXISTS messages_deleted_idx ON messages (deleted) WHERE deleted IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS messages_files_idx ON messages USING GIN (files jsonb_path_ops)`,
+	`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS finalizing boolean`,
+}
+
+// getConfig returns the value of the env variable if it is set, the value of
+// the key in config.ini otherwise.
+func getConfig(cfg *ini.File, env string, section string, key string) string {
+	value := os.Getenv(env)
+	if len(value) == 0 && cfg != nil {
+		value = cfg.Section(section).Key(key).String()
+	}
+	return value
+}
+
+func getDurationConfig(cfg *ini.File, env string, section string, key string, defaultValue time.Duration) (time.Duration, error) {
+	value := getConfig(cfg, env, section, key)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func getIntConfig(cfg *ini.File, env string, section string, key string, defaultValue int64) (int64, error) {
+	value := getConfig(cfg, env, section, key)
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// getFileUrlSecret returns the key signing file urls. Without one a random
+// key is used, urls then stop working when the server restarts.
+func getFileUrlSecret(cfg *ini.File) ([]byte, error) {
+	secret := getConfig(cfg, "FILES_URL_SECRET", "files", "url_secret")
+	if len(secret) > 0 {
+		return []byte(secret), nil
 	}
+	log.Print("No files url_secret configured, using a random one")
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
 
+func createSchema(db *pg.DB) error {
 	for _, model := range models {
 		err := db.Model(model).CreateTable(&orm.CreateTableOptions{})
 		if err != nil {
@@ -129,6 +318,7 @@ func createSchema(db *pg.DB) error {
 
 	db.Model(&Channel{
 		Uuid:         uuid.New().String(),
+		Type:         CHANNEL_TYPE_TEXT,
 		Name:         "general",
 		Description:  "General channel",
 		Nsfw:         false,
@@ -136,18 +326,42 @@ func createSchema(db *pg.DB) error {
 	}).Insert()
 	db.Model(&Channel{
 		Uuid:         uuid.New().String(),
+		Type:         CHANNEL_TYPE_TEXT,
 		Name:         "dev",
 		Description:  "Development channel",
 		Nsfw:         false,
 		SaveMessages: true,
+		Position:     1,
 	}).Insert()
 	db.Model(&Channel{
 		Uuid:         uuid.New().String(),
+		Type:         CHANNEL_TYPE_TEXT,
 		Name:         "tmp",
 		Description:  "Messages sent in this channel won't be saved",
 		Nsfw:         false,
 		SaveMessages: false,
+		Position:     2,
 	}).Insert()
 
 	return nil
 }
+
+func migrateSchema(db *pg.DB) error {
+	for _, model := range models {
+		err := db.Model(model).CreateTable(&orm.CreateTableOptions{
+			IfNotExists: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, migration := range migrations {
+		_, err := db.Exec(migration)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+// ChannelMember gives a user access to a private channel.
+type ChannelMember struct {
+	ChannelUuid string    `pg:",pk" json:"channelUuid"`
+	UserUuid    string    `pg:",pk" json:"userUuid"`
+	Added       time.Time `json:"added"`
+}
+
+// addMember must be called with the permissions lock held.
+func (p *Permissions) addMember(channelUuid string, userUuid string) {
+	members, ok := p.members[channelUuid]
+	if !ok {
+		members = make(map[string]bool)
+		p.members[channelUuid] = members
+	}
+	members[userUuid] = true
+}
+
+type PacketChannelMemberRequest struct {
+	ChannelUuid string `json:"channelUuid"`
+	UserUuid    string `json:"userUuid"`
+}
+
+func (p *PacketChannelMemberRequest) Validate() error {
+	err := validateUuid("channelUuid", p.ChannelUuid)
+	if err != nil {
+		return err
+	}
+	return validateUuid("userUuid", p.UserUuid)
+}
+
+func (server *Server) GetChannelMemberUuids(channelUuid string) []string {
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	userUuids := []string{}
+	for userUuid := range server.Permissions.members[channelUuid] {
+		userUuids = append(userUuids, userUuid)
+	}
+	return userUuids
+}
+
+func (server *Server) privateChannel(channelUuid string) (*Channel, error) {
+	channel := server.GetChannelByUuid(channelUuid)
+	if channel == nil {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", channelUuid)
+	}
+	if !channel.Private {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "channel %s is not private", channelUuid)
+	}
+	return channel, nil
+}
+
+func (server *Server) GetChannelMembers(actorUuid string, channelUuid string) ([]ChannelMember, error) {
+	_, err := server.privateChannel(channelUuid)
+	if err != nil {
+		return nil, err
+	}
+	err = server.Authorize(actorUuid, channelUuid, PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []ChannelMember{}
+	err = server.Db.Model(&members).Where("channel_uuid = ?", channelUuid).Order("added ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// AddChannelMember invites a user in a private channel, which requires
+// managing the channel. Any participant of a group direct message can add
+// users to it until it is full.
+func (server *Server) AddChannelMember(actorUuid string, channelUuid string, userUuid string) error {
+	channel, err := server.privateChannel(channelUuid)
+	if err != nil {
+		return err
+	}
+	switch channel.Type {
+	case CHANNEL_TYPE_DM:
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "direct messages can't have more participants")
+	case CHANNEL_TYPE_GROUP:
+		err = server.Authorize(actorUuid, channelUuid, PERMISSION_VIEW_CHANNEL)
+		if err == nil && len(server.GetChannelMemberUuids(channelUuid)) >= GROUP_MAX_MEMBERS {
+			err = NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "group can't have more than %d participants", GROUP_MAX_MEMBERS)
+		}
+	default:
+		err = server.Authorize(actorUuid, channelUuid, PERMISSION_VIEW_CHANNEL|PERMISSION_MANAGE_CHANNELS)
+	}
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	_, err = server.Db.QueryOne(pg.Scan(&exists), "SELECT EXISTS(SELECT 1 FROM users WHERE uuid = ?)", userUuid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown user %s", userUuid)
+	}
+
+	member := &ChannelMember{
+		ChannelUuid: channelUuid,
+		UserUuid:    userUuid,
+		Added:       time.Now(),
+	}
+	_, err = server.Db.Model(member).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+
+	server.Permissions.mux.Lock()
+	server.Permissions.addMember(channelUuid, userUuid)
+	server.Permissions.mux.Unlock()
+
+	added := *channel
+	if added.IsDirect() {
+		added.MemberUuids = server.GetChannelMemberUuids(channelUuid)
+	}
+
+	go func() {
+		server.Hub.UserBroadcast <- UserPacket{
+			[]string{userUuid},
+			Packet{
+				Type: PACKET_TYPE_ADD_CHANNELS,
+				Data: []Channel{added},
+			},
+		}
+		server.Hub.ChannelBroadcast <- ChannelPacket{
+			channelUuid,
+			Packet{
+				Type: PACKET_TYPE_ADD_MEMBERS,
+				Data: []ChannelMember{*member},
+			},
+		}
+	}()
+
+	return nil
+}
+
+// RemoveChannelMember removes a user from a private channel, members can
+// always remove themselves. Participants of a group direct message can only
+// leave it.
+func (server *Server) RemoveChannelMember(actorUuid string, channelUuid string, userUuid string) error {
+	channel, err := server.privateChannel(channelUuid)
+	if err != nil {
+		return err
+	}
+	switch {
+	case channel.Type == CHANNEL_TYPE_DM:
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "direct messages can't be left")
+	case actorUuid == userUuid:
+	case channel.Type == CHANNEL_TYPE_GROUP:
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "participants can only leave a group")
+	default:
+		err = server.Authorize(actorUuid, channelUuid, PERMISSION_VIEW_CHANNEL|PERMISSION_MANAGE_CHANNELS)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := server.Db.Model(&ChannelMember{ChannelUuid: channelUuid, UserUuid: userUuid}).WherePK().Delete()
+	if err != nil {
+		return err
+	}
+	if r.RowsAffected() == 0 {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "user %s is not a member", userUuid)
+	}
+
+	server.Permissions.mux.Lock()
+	delete(server.Permissions.members[channelUuid], userUuid)
+	server.Permissions.mux.Unlock()
+
+	go func() {
+		server.Hub.UserBroadcast <- UserPacket{
+			[]string{userUuid},
+			Packet{
+				Type: PACKET_TYPE_REMOVE_CHANNELS,
+				Data: []string{channelUuid},
+			},
+		}
+		server.Hub.ChannelBroadcast <- ChannelPacket{
+			channelUuid,
+			Packet{
+				Type: PACKET_TYPE_REMOVE_MEMBERS,
+				Data: []ChannelMember{{ChannelUuid: channelUuid, UserUuid: userUuid}},
+			},
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) HttpGetChannelMembers(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	members, err := s.GetChannelMembers(userUuid, channelUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(members)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPutChannelMember(ctx *fasthttp.RequestCtx) {
+	s.httpSetChannelMember(ctx, s.AddChannelMember)
+}
+
+func (s *Server) HttpDeleteChannelMember(ctx *fasthttp.RequestCtx) {
+	s.httpSetChannelMember(ctx, s.RemoveChannelMember)
+}
+
+func (s *Server) httpSetChannelMember(ctx *fasthttp.RequestCtx, set func(actorUuid string, channelUuid string, userUuid string) error) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	actorUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	userUuid := ctx.UserValue("userUuid")
+	if channelUuid == nil || userUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = set(actorUuid, channelUuid.(string), userUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+type MentionType string
+
+const (
+	MENTION_TYPE_USER    MentionType = "user"
+	MENTION_TYPE_ROLE    MentionType = "role"
+	MENTION_TYPE_CHANNEL MentionType = "channel"
+	MENTION_TYPE_HERE    MentionType = "here"
+)
+
+const (
+	MENTIONS_DEFAULT_COUNT = 25
+	MENTIONS_MAX_COUNT     = 100
+)
+
+// Mentions are written <@userUuid> and <@&roleUuid>, or @login, @channel and
+// @here.
+var (
+	mentionUuidRegexp = regexp.MustCompile(`<@(&?)([0-9a-fA-F-]{36})>`)
+	mentionNameRegexp = regexp.MustCompile(`(?:^|[^\w<])@([\w.-]+)`)
+)
+
+// Mention is the record of a user being mentioned by a message, listed in
+// their inbox until read.
+type Mention struct {
+	MessageUuid string      `pg:",pk" json:"messageUuid"`
+	UserUuid    string      `pg:",pk" json:"-"`
+	ChannelUuid string      `json:"channelUuid"`
+	AuthorUuid  string      `json:"authorUuid"`
+	Type        MentionType `json:"type"`
+	Date        time.Time   `json:"date"`
+	Read        bool        `json:"read"`
+	Message     *Message    `pg:"-" json:"message,omitempty"`
+}
+
+type MentionInbox struct {
+	Mentions []Mention `json:"mentions"`
+	Cursor   string    `json:"cursor,omitempty"`
+}
+
+// parseMentions returns the mentioned user uuids, role uuids and logins, and
+// the broad mentions found in the content.
+func parseMentions(content string) (userUuids []string, roleUuids []string, logins []string, broad []MentionType) {
+	for _, match := range mentionUuidRegexp.FindAllStringSubmatch(content, -1) {
+		if len(match[1]) > 0 {
+			roleUuids = append(roleUuids, strings.ToLower(match[2]))
+		} else {
+			userUuids = append(userUuids, strings.ToLower(match[2]))
+		}
+	}
+	for _, match := range mentionNameRegexp.FindAllStringSubmatch(content, -1) {
+		switch strings.ToLower(match[1]) {
+		case string(MENTION_TYPE_CHANNEL), "everyone":
+			broad = append(broad, MENTION_TYPE_CHANNEL)
+		case string(MENTION_TYPE_HERE):
+			broad = append(broad, MENTION_TYPE_HERE)
+		default:
+			logins = append(logins, strings.ToLower(match[1]))
+		}
+	}
+	return
+}
+
+// resolveMentions maps each mentioned user to the most specific way it was
+// mentioned. Role and broad mentions require PERMISSION_MENTION_EVERYONE.
+func (server *Server) resolveMentions(message *Message) (map[string]MentionType, error) {
+	userUuids, roleUuids, logins, broad := parseMentions(message.Content)
+	mentioned := make(map[string]MentionType)
+
+	canMentionEveryone := server.Authorize(message.UserUuid, message.ChannelUuid, PERMISSION_MENTION_EVERYONE) == nil
+	if canMentionEveryone {
+		// Every user implicitly has the member role.
+		server.Permissions.mux.RLock()
+		if member := server.Permissions.roleByKey(ROLE_KEY_MEMBER); member != nil {
+			for _, roleUuid := range roleUuids {
+				if roleUuid == member.Uuid {
+					broad = append(broad, MENTION_TYPE_CHANNEL)
+				}
+			}
+		}
+		server.Permissions.mux.RUnlock()
+
+		for _, mentionType := range broad {
+			var candidates []string
+			if mentionType == MENTION_TYPE_HERE {
+				for userUuid := range server.Hub.GetPresences(message.UserUuid) {
+					candidates = append(candidates, userUuid)
+				}
+			} else {
+				_, err := server.Db.Query(&candidates, "SELECT uuid FROM users WHERE NOT coalesce(banned, false)")
+				if err != nil {
+					return nil, err
+				}
+			}
+			for _, userUuid := range candidates {
+				mentioned[userUuid] = mentionType
+			}
+		}
+
+		server.Permissions.mux.RLock()
+		for userUuid, userRoleUuids := range server.Permissions.userRoles {
+			for _, roleUuid := range userRoleUuids {
+				for _, mentionedRoleUuid := range roleUuids {
+					if roleUuid == mentionedRoleUuid {
+						mentioned[userUuid] = MENTION_TYPE_ROLE
+					}
+				}
+			}
+		}
+		server.Permissions.mux.RUnlock()
+	}
+
+	if len(logins) > 0 {
+		var loginUuids []string
+		_, err := server.Db.Query(&loginUuids, "SELECT uuid FROM users WHERE lower(login) IN (?)", pg.In(logins))
+		if err != nil {
+			return nil, err
+		}
+		userUuids = append(userUuids, loginUuids...)
+	}
+	for _, userUuid := range userUuids {
+		mentioned[userUuid] = MENTION_TYPE_USER
+	}
+
+	delete(mentioned, message.UserUuid)
+
+	channel := server.GetChannelByUuid(message.ChannelUuid)
+	for userUuid := range mentioned {
+		if channel == nil || !server.CanView(userUuid, channel) {
+			delete(mentioned, userUuid)
+		}
+	}
+
+	return mentioned, nil
+}
+
+// NotifyMentions stores the mentions of a new message and sends a
+// PACKET_TYPE_MENTION to the mentioned users.
+func (server *Server) NotifyMentions(message *Message, saved bool) error {
+	if len(message.Content) == 0 || !strings.Contains(message.Content, "@") {
+		return nil
+	}
+
+	mentioned, err := server.resolveMentions(message)
+	if err != nil || len(mentioned) == 0 {
+		return err
+	}
+
+	mentions := make([]Mention, 0, len(mentioned))
+	for userUuid, mentionType := range mentioned {
+		mentions = append(mentions, Mention{
+			MessageUuid: message.Uuid,
+			UserUuid:    userUuid,
+			ChannelUuid: message.ChannelUuid,
+			AuthorUuid:  message.UserUuid,
+			Type:        mentionType,
+			Date:        message.Date,
+		})
+	}
+
+	// Mentions of unsaved messages are only notified, the inbox couldn't
+	// show the message.
+	if saved {
+		_, err = server.Db.Model(&mentions).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+	}
+
+	byType := make(map[MentionType][]string)
+	for userUuid, mentionType := range mentioned {
+		byType[mentionType] = append(byType[mentionType], userUuid)
+	}
+	for mentionType, userUuids := range byType {
+		server.Hub.UserBroadcast <- UserPacket{
+			userUuids,
+			Packet{
+				Type: PACKET_TYPE_MENTION,
+				Data: Mention{
+					MessageUuid: message.Uuid,
+					ChannelUuid: message.ChannelUuid,
+					AuthorUuid:  message.UserUuid,
+					Type:        mentionType,
+					Date:        message.Date,
+					Message:     message,
+				},
+			},
+		}
+	}
+
+	return nil
+}
+
+// GetMentions returns the mentions of the user in the channels it can still
+// read, most recent first.
+func (server *Server) GetMentions(userUuid string, unreadOnly bool, cursor string, count int) (*MentionInbox, error) {
+	if count <= 0 || count > MENTIONS_MAX_COUNT {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be between 1 and %d", MENTIONS_MAX_COUNT)
+	}
+
+	inbox := &MentionInbox{
+		Mentions: []Mention{},
+	}
+	channelUuids := server.GetReadableChannelUuids(userUuid)
+	if len(channelUuids) == 0 {
+		return inbox, nil
+	}
+
+	query := server.Db.Model(&inbox.Mentions).
+		Where("user_uuid = ?", userUuid).
+		Where("channel_uuid IN (?)", pg.In(channelUuids)).
+		Where("message_uuid IN (SELECT uuid FROM messages WHERE deleted IS NULL)")
+	if unreadOnly {
+		query.Where("NOT coalesce(read, false)")
+	}
+	if len(cursor) > 0 {
+		c, err := decodeMessageCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query.Where("(date, message_uuid) < (?, ?)", c.date, c.uuid)
+	}
+	err := query.Order("date DESC", "message_uuid DESC").Limit(count + 1).Select()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inbox.Mentions) > count {
+		inbox.Mentions = inbox.Mentions[:count]
+		last := inbox.Mentions[count-1]
+		inbox.Cursor = encodeMessageCursor(&Message{Uuid: last.MessageUuid, Date: last.Date})
+	}
+
+	if len(inbox.Mentions) > 0 {
+		messageUuids := make([]string, 0, len(inbox.Mentions))
+		for _, mention := range inbox.Mentions {
+			messageUuids = append(messageUuids, mention.MessageUuid)
+		}
+		var messages []Message
+		err = server.Db.Model(&messages).Where("uuid IN (?)", pg.In(messageUuids)).Select()
+		if err != nil {
+			return nil, err
+		}
+		for i := range inbox.Mentions {
+			for j := range messages {
+				if messages[j].Uuid == inbox.Mentions[i].MessageUuid {
+					inbox.Mentions[i].Message = &messages[j]
+				}
+			}
+		}
+	}
+
+	return inbox, nil
+}
+
+// MarkMentionsRead marks the given mentions as read, or every mention of the
+// user in the channel, or all of them when both are empty.
+func (server *Server) MarkMentionsRead(userUuid string, messageUuids []string, channelUuid string) error {
+	err := validateUuids("message", messageUuids, PACKET_MAX_UUIDS)
+	if err != nil {
+		return err
+	}
+
+	query := server.Db.Model((*Mention)(nil)).Set("read = true").Where("user_uuid = ?", userUuid)
+	if len(messageUuids) > 0 {
+		query.Where("message_uuid IN (?)", pg.In(messageUuids))
+	}
+	if len(channelUuid) > 0 {
+		query.Where("channel_uuid = ?", channelUuid)
+	}
+	_, err = query.Update()
+	return err
+}
+
+func (s *Server) HttpGetMentions(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	unreadOnly := true
+	if value, err := HttpOptionalFormBool(ctx, "unread"); err != nil {
+		HttpError(ctx, err)
+		return
+	} else if value != nil {
+		unreadOnly = *value
+	}
+
+	count := MENTIONS_DEFAULT_COUNT
+	if value := HttpOptionalFormValue(ctx, "count"); value != nil {
+		count, err = strconv.Atoi(*value)
+		if err != nil {
+			HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be an integer"))
+			return
+		}
+	}
+
+	inbox, err := s.GetMentions(userUuid, unreadOnly, string(ctx.FormValue("cursor")), count)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(inbox)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpMarkMentionsRead(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	messageUuids := []string{}
+	for _, messageUuid := range ctx.PostArgs().PeekMulti("message") {
+		messageUuids = append(messageUuids, string(messageUuid))
+	}
+
+	err = s.MarkMentionsRead(userUuid, messageUuids, string(ctx.FormValue("channel")))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+// notifyMentions runs after a message was delivered, failing to notify
+// mentions doesn't fail the message.
+func (client *Client) notifyMentions(message *Message, saved bool) {
+	err := client.Hub.Server.NotifyMentions(message, saved)
+	if err != nil {
+		log.Print("mentions: ", err)
+	}
+}
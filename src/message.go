@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type Message struct {
 	Uuid        string    `json:"uuid"`
@@ -10,4 +13,73 @@ type Message struct {
 	Edited      time.Time `json:"edited"`
 	Content     string    `json:"content"`
 	Files       []string  `json:"files"`
+	Nonce       string    `json:"nonce,omitempty"`
+	// ReplyToUuid is the message quoted by this one, ReplyTo holds its
+	// content when it still exists.
+	ReplyToUuid string        `json:"replyToUuid,omitempty"`
+	ReplyTo     *MessageQuote `pg:"-" json:"replyTo,omitempty"`
+	// ThreadUuid is the root message of the thread this message was posted
+	// in, root messages keep count of their replies.
+	ThreadUuid      string          `json:"threadUuid,omitempty"`
+	ThreadCount     int             `json:"threadCount"`
+	ThreadLastReply time.Time       `json:"threadLastReply"`
+	Reactions       []ReactionCount `pg:"-" json:"reactions,omitempty"`
+	// Deleted messages are hidden from every query until they are restored
+	// or purged.
+	Deleted   *time.Time `pg:",soft_delete" json:"deleted,omitempty"`
+	DeletedBy string     `json:"deletedBy,omitempty"`
+}
+
+const (
+	MESSAGE_NONCE_TTL         = 10 * time.Minute
+	MESSAGE_NONCE_CACHE_SWEEP = 1024
+)
+
+// NonceCache remembers recently sent messages by author and client nonce so
+// retried sends are acknowledged with the original message instead of being
+// delivered twice, including in channels that don't save messages.
+type NonceCache struct {
+	mux     sync.Mutex
+	entries map[string]nonceCacheEntry
+}
+
+type nonceCacheEntry struct {
+	message *Message
+	expires time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{
+		entries: make(map[string]nonceCacheEntry),
+	}
+}
+
+func (cache *NonceCache) Get(userUuid string, nonce string) *Message {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	entry, ok := cache.entries[userUuid+"/"+nonce]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.message
+}
+
+func (cache *NonceCache) Put(userUuid string, nonce string, message *Message) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	now := time.Now()
+	if len(cache.entries) >= MESSAGE_NONCE_CACHE_SWEEP {
+		for key, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+
+	cache.entries[userUuid+"/"+nonce] = nonceCacheEntry{
+		message,
+		now.Add(MESSAGE_NONCE_TTL),
+	}
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+// HubMetrics are counters updated from any goroutine with sync/atomic.
+type HubMetrics struct {
+	DroppedPackets      int64
+	OverflowDisconnects int64
+}
+
+// HubStats is a snapshot of the hub state taken by its goroutine.
+type HubStats struct {
+	Clients             int
+	Channels            int
+	QueuedPackets       int
+	MaxQueueDepth       int
+	SendQueueSize       int
+	DroppedPackets      int64
+	OverflowDisconnects int64
+}
+
+func (hub *Hub) stats() HubStats {
+	stats := HubStats{
+		Clients:             len(hub.Clients),
+		Channels:            len(hub.Channels),
+		SendQueueSize:       hub.Server.WebSocket.SendQueueSize,
+		DroppedPackets:      atomic.LoadInt64(&hub.Metrics.DroppedPackets),
+		OverflowDisconnects: atomic.LoadInt64(&hub.Metrics.OverflowDisconnects),
+	}
+	for c := range hub.Clients {
+		depth := c.Queue.Len()
+		stats.QueuedPackets += depth
+		if depth > stats.MaxQueueDepth {
+			stats.MaxQueueDepth = depth
+		}
+	}
+	return stats
+}
+
+// HttpGetMetrics requires either the metrics token configured for scrapers,
+// sent as a bearer token, or the token of an administrator.
+func (s *Server) HttpGetMetrics(ctx *fasthttp.RequestCtx) {
+	authorization := ctx.Request.Header.Peek("Authorization")
+	bearer := bytes.TrimPrefix(authorization, []byte("Bearer "))
+	if len(s.MetricsToken) == 0 || len(bearer) == len(authorization) || subtle.ConstantTimeCompare(bearer, []byte(s.MetricsToken)) != 1 {
+		token := string(ctx.Request.Header.Peek("token"))
+
+		userUuid, err := s.GetUserUuidByToken(token)
+		if err != nil {
+			if err == pg.ErrNoRows {
+				ctx.Error("", fasthttp.StatusUnauthorized)
+			} else {
+				HttpInternalServerError(ctx, err)
+			}
+			return
+		}
+
+		err = s.Authorize(userUuid, "", PERMISSION_ADMINISTRATOR)
+		if err != nil {
+			HttpError(ctx, err)
+			return
+		}
+	}
+
+	statsChan := make(chan HubStats)
+	s.Hub.Stats <- statsChan
+	stats := <-statsChan
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_clients gauge\nchattin_ws_clients %d\n", stats.Clients)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_subscribed_channels gauge\nchattin_ws_subscribed_channels %d\n", stats.Channels)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_send_queue_size gauge\nchattin_ws_send_queue_size %d\n", stats.SendQueueSize)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_send_queue_depth gauge\nchattin_ws_send_queue_depth %d\n", stats.QueuedPackets)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_send_queue_depth_max gauge\nchattin_ws_send_queue_depth_max %d\n", stats.MaxQueueDepth)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_send_queue_dropped_total counter\nchattin_ws_send_queue_dropped_total %d\n", stats.DroppedPackets)
+	fmt.Fprintf(ctx, "# TYPE chattin_ws_send_queue_overflows_total counter\nchattin_ws_send_queue_overflows_total %d\n", stats.OverflowDisconnects)
+}
@@ -2,32 +2,78 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
 )
 
+// Packet is sent to clients. Events are stamped with a seq which a client
+// gives back when it reconnects, packets of a same event share its seq.
 type Packet struct {
 	Type PacketType  `json:"type"`
+	Id   string      `json:"id,omitempty"`
+	Seq  uint64      `json:"seq,omitempty"`
 	Data interface{} `json:"data"`
 }
 
+// RawPacket is a packet received from a client, its data is decoded once the
+// type is known.
+type RawPacket struct {
+	Type PacketType      `json:"type"`
+	Id   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
 type PacketType int
 
 const (
-	PACKET_TYPE_AUTH             PacketType = 0
-	PACKET_TYPE_ONLINE_USERS     PacketType = 1
-	PACKET_TYPE_OFFLINE_USERS    PacketType = 2
-	PACKET_TYPE_ADD_USERS        PacketType = 3
-	PACKET_TYPE_REMOVE_USERS     PacketType = 4
-	PACKET_TYPE_UPDATE_USERS     PacketType = 5
-	PACKET_TYPE_MESSAGE          PacketType = 6
-	PACKET_TYPE_SET_CHANNEL_UUID PacketType = 7
-	PACKET_TYPE_TYPING           PacketType = 8
-	PACKET_TYPE_DELETE_MESSAGE   PacketType = 9
-	PACKET_TYPE_EDIT_MESSAGE     PacketType = 10
+	PACKET_TYPE_AUTH               PacketType = 0
+	PACKET_TYPE_ONLINE_USERS       PacketType = 1
+	PACKET_TYPE_OFFLINE_USERS      PacketType = 2
+	PACKET_TYPE_ADD_USERS          PacketType = 3
+	PACKET_TYPE_REMOVE_USERS       PacketType = 4
+	PACKET_TYPE_UPDATE_USERS       PacketType = 5
+	PACKET_TYPE_MESSAGE            PacketType = 6
+	PACKET_TYPE_SET_CHANNEL_UUID   PacketType = 7
+	PACKET_TYPE_TYPING             PacketType = 8
+	PACKET_TYPE_DELETE_MESSAGE     PacketType = 9
+	PACKET_TYPE_EDIT_MESSAGE       PacketType = 10
+	PACKET_TYPE_SUBSCRIBE          PacketType = 11
+	PACKET_TYPE_UNSUBSCRIBE        PacketType = 12
+	PACKET_TYPE_ERROR              PacketType = 13
+	PACKET_TYPE_ACK                PacketType = 14
+	PACKET_TYPE_SET_STATUS         PacketType = 15
+	PACKET_TYPE_SET_IDLE           PacketType = 16
+	PACKET_TYPE_PRESENCE           PacketType = 17
+	PACKET_TYPE_ADD_CHANNELS       PacketType = 18
+	PACKET_TYPE_REMOVE_CHANNELS    PacketType = 19
+	PACKET_TYPE_UPDATE_CHANNELS    PacketType = 20
+	PACKET_TYPE_REORDER_CHANNELS   PacketType = 21
+	PACKET_TYPE_UPDATE_ROLES       PacketType = 22
+	PACKET_TYPE_ADD_MEMBERS        PacketType = 23
+	PACKET_TYPE_REMOVE_MEMBERS     PacketType = 24
+	PACKET_TYPE_SUBSCRIBE_THREAD   PacketType = 25
+	PACKET_TYPE_UNSUBSCRIBE_THREAD PacketType = 26
+	PACKET_TYPE_UPDATE_THREAD      PacketType = 27
+	PACKET_TYPE_ADD_REACTION       PacketType = 28
+	PACKET_TYPE_REMOVE_REACTION    PacketType = 29
+	PACKET_TYPE_MENTION            PacketType = 30
+	PACKET_TYPE_READ               PacketType = 31
+	PACKET_TYPE_RESTORE_MESSAGE    PacketType = 32
+	PACKET_TYPE_RESYNC             PacketType = 33
 )
 
-func ParsePacketJson(packetJson []byte) (*Packet, error) {
-	packet := &Packet{}
+const (
+	MESSAGE_MAX_LENGTH = 4000
+	MESSAGE_MAX_FILES  = 10
+	PACKET_MAX_UUIDS   = 100
+	PACKET_MAX_ID_LEN  = 64
+)
+
+func ParsePacketJson(packetJson []byte) (*RawPacket, error) {
+	packet := &RawPacket{}
 	err := json.Unmarshal(packetJson, packet)
 	if err != nil {
 		return nil, err
@@ -35,9 +81,144 @@ func ParsePacketJson(packetJson []byte) (*Packet, error) {
 	return packet, nil
 }
 
+// DecodeData decodes the packet data into v, rejecting missing data and
+// values of the wrong JSON type.
+func (packet *RawPacket) DecodeData(v interface{}) error {
+	if len(packet.Data) == 0 || string(packet.Data) == "null" {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "missing data")
+	}
+	err := json.Unmarshal(packet.Data, v)
+	if err != nil {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, err.Error())
+	}
+	return nil
+}
+
+type ErrorCode string
+
+const (
+	ERROR_CODE_INVALID_JSON        ErrorCode = "invalid_json"
+	ERROR_CODE_INVALID_PAYLOAD     ErrorCode = "invalid_payload"
+	ERROR_CODE_UNKNOWN_PACKET_TYPE ErrorCode = "unknown_packet_type"
+	ERROR_CODE_UNKNOWN_CHANNEL     ErrorCode = "unknown_channel"
+	ERROR_CODE_NOT_FOUND           ErrorCode = "not_found"
+	ERROR_CODE_CONFLICT            ErrorCode = "conflict"
+	ERROR_CODE_FORBIDDEN           ErrorCode = "forbidden"
+	ERROR_CODE_INTERNAL            ErrorCode = "internal_error"
+)
+
+// PacketError is sent back to the client in a PACKET_TYPE_ERROR packet when
+// one of its packets is rejected.
+type PacketError struct {
+	Code    ErrorCode  `json:"code"`
+	Message string     `json:"message"`
+	Type    PacketType `json:"type"`
+	Id      string     `json:"id,omitempty"`
+}
+
+func NewPacketError(code ErrorCode, format string, a ...interface{}) *PacketError {
+	return &PacketError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func validateUuid(field string, value string) error {
+	_, err := uuid.Parse(value)
+	if err != nil {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s must be a valid uuid", field)
+	}
+	return nil
+}
+
+func validateUuids(field string, values []string, max int) error {
+	if len(values) > max {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s can't contain more than %d uuids", field, max)
+	}
+	for _, value := range values {
+		err := validateUuid(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateContent(field string, value string, allowEmpty bool) error {
+	if !utf8.ValidString(value) {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s must be valid utf-8", field)
+	}
+	length := utf8.RuneCountInString(value)
+	if length == 0 && !allowEmpty {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s is required", field)
+	}
+	if length > MESSAGE_MAX_LENGTH {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s can't be longer than %d characters", field, MESSAGE_MAX_LENGTH)
+	}
+	return nil
+}
+
+// PacketAck is sent back to the client in a PACKET_TYPE_ACK packet once a
+// packet carrying an id has been processed.
+type PacketAck struct {
+	Type PacketType  `json:"type"`
+	Id   string      `json:"id"`
+	Data interface{} `json:"data,omitempty"`
+}
+
 type PacketAuth struct {
 	UserUuid    string `json:"userUuid"`
 	ChannelUuid string `json:"channelUuid"`
+	SessionId   string `json:"sessionId"`
+}
+
+type PacketMessageRequest struct {
+	ChannelUuid string   `json:"channelUuid"`
+	Content     string   `json:"content"`
+	Files       []string `json:"files"`
+	ReplyToUuid string   `json:"replyToUuid"`
+	ThreadUuid  string   `json:"threadUuid"`
+}
+
+func (p *PacketMessageRequest) Validate() error {
+	err := validateUuid("channelUuid", p.ChannelUuid)
+	if err != nil {
+		return err
+	}
+	err = validateContent("content", p.Content, len(p.Files) > 0)
+	if err != nil {
+		return err
+	}
+	if len(p.ReplyToUuid) > 0 {
+		err = validateUuid("replyToUuid", p.ReplyToUuid)
+		if err != nil {
+			return err
+		}
+	}
+	if len(p.ThreadUuid) > 0 {
+		err = validateUuid("threadUuid", p.ThreadUuid)
+		if err != nil {
+			return err
+		}
+	}
+	return validateUuids("files", p.Files, MESSAGE_MAX_FILES)
+}
+
+type PacketEditMessageRequest struct {
+	MessageUuid string `json:"messageUuid"`
+	Content     string `json:"content"`
+}
+
+func (p *PacketEditMessageRequest) Validate() error {
+	err := validateUuid("messageUuid", p.MessageUuid)
+	if err != nil {
+		return err
+	}
+	return validateContent("content", p.Content, false)
 }
 
 type PacketEditMessage struct {
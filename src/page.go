@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	MESSAGES_DEFAULT_COUNT = 50
+	MESSAGES_MAX_COUNT     = 100
+)
+
+// messageCursor points after the last message of a page, pages are sorted
+// by date and uuid so it stays valid while new messages are posted.
+type messageCursor struct {
+	date time.Time
+	uuid string
+}
+
+func encodeMessageCursor(message *Message) string {
+	value := message.Date.UTC().Format(time.RFC3339Nano) + "," + message.Uuid
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeMessageCursor(cursor string) (*messageCursor, error) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "invalid cursor")
+	}
+	parts := strings.SplitN(string(value), ",", 2)
+	if len(parts) != 2 {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "invalid cursor")
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "invalid cursor")
+	}
+	return &messageCursor{date, parts[1]}, nil
+}
+
+// MessagePageRequest anchors a page of history before, after or around a
+// message. Anchors are either a cursor of a previous page or a message uuid.
+type MessagePageRequest struct {
+	Before string
+	After  string
+	Around string
+	Count  int
+}
+
+func (r *MessagePageRequest) Validate() error {
+	anchors := 0
+	for _, anchor := range []string{r.Before, r.After, r.Around} {
+		if len(anchor) > 0 {
+			anchors++
+		}
+	}
+	if anchors > 1 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "only one of before, after and around can be given")
+	}
+	if r.Count <= 0 || r.Count > MESSAGES_MAX_COUNT {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be between 1 and %d", MESSAGES_MAX_COUNT)
+	}
+	return nil
+}
+
+// MessagePage is sorted from the most recent message. Before fetches the
+// older messages and After the newer ones, they are empty when there is
+// none.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+}
+
+// resolveMessageAnchor turns an anchor into a cursor, message uuids must
+// match the scope of the page.
+func (server *Server) resolveMessageAnchor(anchor string, scope string, scopeValue string) (*messageCursor, error) {
+	if validateUuid("anchor", anchor) != nil {
+		return decodeMessageCursor(anchor)
+	}
+
+	message := &Message{
+		Uuid: anchor,
+	}
+	// Deleted messages still anchor the page they were part of.
+	err := server.Db.Model(message).WherePK().Where(scope, scopeValue).Column("uuid", "date").AllWithDeleted().Select()
+	if err != nil {
+		return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", anchor)
+	}
+	return &messageCursor{message.Date, message.Uuid}, nil
+}
+
+// selectMessages returns up to count messages on one side of the cursor,
+// most recent first, and whether there are more. Thread roots deleted
+// without their replies are returned as tombstones while replies remain.
+func (server *Server) selectMessages(scope string, scopeValue string, cursor *messageCursor, newer bool, inclusive bool, count int) ([]Message, bool, error) {
+	messages := []Message{}
+	query := server.Db.Model(&messages).Where(scope, scopeValue).
+		Where("message.deleted IS NULL OR EXISTS (SELECT 1 FROM messages AS reply WHERE reply.thread_uuid = message.uuid AND reply.deleted IS NULL)").
+		AllWithDeleted()
+	if cursor != nil {
+		operator := "<"
+		if newer {
+			operator = ">"
+		}
+		if inclusive {
+			operator += "="
+		}
+		query.Where("(date, uuid) "+operator+" (?, ?)", cursor.date, cursor.uuid)
+	}
+	if newer {
+		query.Order("date ASC", "uuid ASC")
+	} else {
+		query.Order("date DESC", "uuid DESC")
+	}
+	err := query.Limit(count + 1).Select()
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(messages) > count
+	if more {
+		messages = messages[:count]
+	}
+	for i := range messages {
+		if messages[i].Deleted != nil {
+			messages[i] = threadTombstone(&messages[i])
+		}
+	}
+	if newer {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, more, nil
+}
+
+// threadTombstone keeps only what a deleted thread root needs to still lead
+// to its replies.
+func threadTombstone(message *Message) Message {
+	return Message{
+		Uuid:            message.Uuid,
+		ChannelUuid:     message.ChannelUuid,
+		Date:            message.Date,
+		Files:           []string{},
+		ThreadCount:     message.ThreadCount,
+		ThreadLastReply: message.ThreadLastReply,
+		Deleted:         message.Deleted,
+		DeletedBy:       message.DeletedBy,
+	}
+}
+
+// GetMessagePage returns a page of the messages matching the scope, which is
+// a condition on a single value such as the channel or the thread.
+func (server *Server) GetMessagePage(scope string, scopeValue string, request MessagePageRequest) (*MessagePage, error) {
+	var cursor *messageCursor
+	for _, anchor := range []string{request.Before, request.After, request.Around} {
+		if len(anchor) > 0 {
+			var err error
+			cursor, err = server.resolveMessageAnchor(anchor, scope, scopeValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	page := &MessagePage{}
+	var older, newer bool
+	var err error
+	switch {
+	case len(request.After) > 0:
+		page.Messages, newer, err = server.selectMessages(scope, scopeValue, cursor, true, false, request.Count)
+		older = true
+	case len(request.Around) > 0:
+		// The anchor is part of the newer half so that it is always returned.
+		var olderMessages []Message
+		olderMessages, older, err = server.selectMessages(scope, scopeValue, cursor, false, false, request.Count/2)
+		if err != nil {
+			return nil, err
+		}
+		page.Messages, newer, err = server.selectMessages(scope, scopeValue, cursor, true, true, request.Count-request.Count/2)
+		page.Messages = append(page.Messages, olderMessages...)
+	default:
+		page.Messages, older, err = server.selectMessages(scope, scopeValue, cursor, false, false, request.Count)
+		newer = cursor != nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Messages) > 0 {
+		if older {
+			page.Before = encodeMessageCursor(&page.Messages[len(page.Messages)-1])
+		}
+		if newer {
+			page.After = encodeMessageCursor(&page.Messages[0])
+		}
+	} else if cursor != nil {
+		// An empty page still lets the client go back where it came from.
+		if older {
+			page.Before = encodeMessageCursor(&Message{Uuid: cursor.uuid, Date: cursor.date})
+		}
+		if newer {
+			page.After = encodeMessageCursor(&Message{Uuid: cursor.uuid, Date: cursor.date})
+		}
+	}
+	return page, nil
+}
+
+// httpMessagePage answers with a page of history read from the request
+// arguments, "from" is kept as an alias of "before".
+func (s *Server) httpMessagePage(ctx *fasthttp.RequestCtx, userUuid string, scope string, scopeValue string) {
+	request := MessagePageRequest{
+		Before: string(ctx.FormValue("before")),
+		After:  string(ctx.FormValue("after")),
+		Around: string(ctx.FormValue("around")),
+		Count:  MESSAGES_DEFAULT_COUNT,
+	}
+	if len(request.Before) == 0 {
+		request.Before = string(ctx.FormValue("from"))
+	}
+	if value := HttpOptionalFormValue(ctx, "count"); value != nil {
+		count, err := strconv.Atoi(*value)
+		if err != nil {
+			HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be an integer"))
+			return
+		}
+		request.Count = count
+	}
+	err := request.Validate()
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	page, err := s.GetMessagePage(scope, scopeValue, request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	err = s.LoadReplyQuotes(page.Messages)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	err = s.LoadReactions(page.Messages, userUuid)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(page)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sync"
+)
+
+type Permission int64
+
+const (
+	// PERMISSION_ADMINISTRATOR grants every permission and ignores channel
+	// overrides.
+	PERMISSION_ADMINISTRATOR Permission = 1 << iota
+	PERMISSION_MANAGE_CHANNELS
+	PERMISSION_MANAGE_ROLES
+	PERMISSION_MANAGE_MESSAGES
+	PERMISSION_KICK_MEMBERS
+	PERMISSION_BAN_MEMBERS
+	PERMISSION_VIEW_CHANNEL
+	PERMISSION_SEND_MESSAGES
+	PERMISSION_UPLOAD_FILES
+	PERMISSION_MENTION_EVERYONE
+
+	PERMISSION_ALL Permission = 1<<iota - 1
+
+	// PERMISSION_DIRECT_MESSAGES are the only permissions that apply in
+	// direct messages.
+	PERMISSION_DIRECT_MESSAGES = PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES | PERMISSION_UPLOAD_FILES
+)
+
+const (
+	ROLE_KEY_OWNER     = "owner"
+	ROLE_KEY_ADMIN     = "admin"
+	ROLE_KEY_MODERATOR = "moderator"
+	ROLE_KEY_MEMBER    = "member"
+)
+
+// ChannelOverride allows and denies permissions in a channel to a role or a
+// single user, the target uuid tells which.
+type ChannelOverride struct {
+	ChannelUuid string     `pg:",pk" json:"channelUuid"`
+	TargetUuid  string     `pg:",pk" json:"targetUuid"`
+	Allow       Permission `json:"allow"`
+	Deny        Permission `json:"deny"`
+}
+
+// Permissions is the in-memory copy of roles, role assignments and channel
+// overrides used to authorize every request without hitting the database.
+type Permissions struct {
+	mux       sync.RWMutex
+	roles     []*Role
+	userRoles map[string][]string
+	overrides map[string][]*ChannelOverride
+	members   map[string]map[string]bool
+}
+
+func (server *Server) LoadPermissions() error {
+	var roles []*Role
+	err := server.Db.Model(&roles).Order("position DESC").Select()
+	if err != nil {
+		return err
+	}
+
+	var userRoles []UserRole
+	err = server.Db.Model(&userRoles).Select()
+	if err != nil {
+		return err
+	}
+
+	var overrides []*ChannelOverride
+	err = server.Db.Model(&overrides).Select()
+	if err != nil {
+		return err
+	}
+
+	var members []ChannelMember
+	err = server.Db.Model(&members).Select()
+	if err != nil {
+		return err
+	}
+
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.roles = roles
+	p.userRoles = make(map[string][]string)
+	for _, userRole := range userRoles {
+		p.userRoles[userRole.UserUuid] = append(p.userRoles[userRole.UserUuid], userRole.RoleUuid)
+	}
+	p.overrides = make(map[string][]*ChannelOverride)
+	for _, override := range overrides {
+		p.overrides[override.ChannelUuid] = append(p.overrides[override.ChannelUuid], override)
+	}
+	p.members = make(map[string]map[string]bool)
+	for _, member := range members {
+		p.addMember(member.ChannelUuid, member.UserUuid)
+	}
+
+	return nil
+}
+
+func (p *Permissions) roleByUuid(roleUuid string) *Role {
+	for _, role := range p.roles {
+		if role.Uuid == roleUuid {
+			return role
+		}
+	}
+	return nil
+}
+
+func (p *Permissions) roleByKey(key string) *Role {
+	for _, role := range p.roles {
+		if role.Key == key {
+			return role
+		}
+	}
+	return nil
+}
+
+// rolesOf returns the roles of the user including the implicit member
+// role.
+func (p *Permissions) rolesOf(userUuid string) []*Role {
+	roles := []*Role{}
+	if member := p.roleByKey(ROLE_KEY_MEMBER); member != nil {
+		roles = append(roles, member)
+	}
+	for _, roleUuid := range p.userRoles[userUuid] {
+		if role := p.roleByUuid(roleUuid); role != nil {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func (p *Permissions) isOwner(userUuid string) bool {
+	for _, role := range p.rolesOf(userUuid) {
+		if role.Key == ROLE_KEY_OWNER {
+			return true
+		}
+	}
+	return false
+}
+
+// highestPosition returns the position of the highest role of the user, it
+// can only manage roles and users strictly below it.
+func (p *Permissions) highestPosition(userUuid string) int {
+	position := 0
+	for _, role := range p.rolesOf(userUuid) {
+		if role.Position > position {
+			position = role.Position
+		}
+	}
+	return position
+}
+
+// compute applies the member role override, then the overrides of the
+// other roles of the user, then the override of the user itself. Users get
+// no permission at all in private channels they aren't a member of, and
+// direct messages are never visible to anyone but their participants.
+func (p *Permissions) compute(userUuid string, channel *Channel) Permission {
+	roles := p.rolesOf(userUuid)
+
+	var permissions Permission
+	for _, role := range roles {
+		permissions |= role.Permissions
+	}
+	if channel != nil && channel.IsDirect() {
+		if !p.members[channel.Uuid][userUuid] {
+			return 0
+		}
+		if permissions&PERMISSION_ADMINISTRATOR != 0 {
+			permissions = PERMISSION_ALL
+		}
+		return permissions & PERMISSION_DIRECT_MESSAGES
+	}
+	if permissions&PERMISSION_ADMINISTRATOR != 0 {
+		return PERMISSION_ALL
+	}
+	if channel == nil {
+		return permissions
+	}
+	if channel.Private && !p.members[channel.Uuid][userUuid] {
+		return 0
+	}
+
+	overrides := make(map[string]*ChannelOverride)
+	for _, override := range p.overrides[channel.Uuid] {
+		overrides[override.TargetUuid] = override
+	}
+
+	var allow, deny Permission
+	for _, role := range roles {
+		override, ok := overrides[role.Uuid]
+		if !ok {
+			continue
+		}
+		if role.Key == ROLE_KEY_MEMBER {
+			permissions = permissions&^override.Deny | override.Allow
+		} else {
+			allow |= override.Allow
+			deny |= override.Deny
+		}
+	}
+	permissions = permissions&^deny | allow
+
+	if override, ok := overrides[userUuid]; ok {
+		permissions = permissions&^override.Deny | override.Allow
+	}
+
+	return permissions
+}
+
+// GetPermissions returns the permissions of the user in the channel, or its
+// server-wide permissions when channelUuid is empty.
+func (server *Server) GetPermissions(userUuid string, channelUuid string) Permission {
+	var channel *Channel
+	if len(channelUuid) > 0 {
+		channel = server.GetChannelByUuid(channelUuid)
+		if channel == nil {
+			return 0
+		}
+	}
+
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	return server.Permissions.compute(userUuid, channel)
+}
+
+// CanView tells whether the user may see the channel and its messages.
+func (server *Server) CanView(userUuid string, channel *Channel) bool {
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	return server.Permissions.compute(userUuid, channel)&PERMISSION_VIEW_CHANNEL != 0
+}
+
+// Authorize is the single authorization check shared by HTTP handlers and
+// websocket packets.
+func (server *Server) Authorize(userUuid string, channelUuid string, permission Permission) error {
+	if server.GetPermissions(userUuid, channelUuid)&permission != permission {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "missing permission")
+	}
+	return nil
+}
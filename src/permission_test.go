@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+// newTestPermissions builds the in-memory permissions LoadPermissions would,
+// with the builtin roles, a manager role and the given role assignments. Role
+// uuids are their keys.
+func newTestPermissions(userRoles map[string][]string) *Permissions {
+	p := &Permissions{
+		userRoles: userRoles,
+		overrides: make(map[string][]*ChannelOverride),
+		members:   make(map[string]map[string]bool),
+	}
+	p.roles = append(p.roles, &Role{
+		Uuid:        "manager",
+		Key:         "manager",
+		Permissions: PERMISSION_MANAGE_ROLES | PERMISSION_MANAGE_CHANNELS | PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES,
+		Position:    100,
+	})
+	for i := range builtinRoles {
+		role := builtinRoles[i]
+		role.Uuid = role.Key
+		p.roles = append(p.roles, &role)
+	}
+	return p
+}
+
+func TestComputePermissions(t *testing.T) {
+	p := newTestPermissions(map[string][]string{
+		"owner":   {ROLE_KEY_OWNER},
+		"admin":   {ROLE_KEY_ADMIN},
+		"mod":     {ROLE_KEY_MODERATOR},
+		"muted":   {ROLE_KEY_MODERATOR},
+		"manager": {"manager"},
+		"quiet":   {ROLE_KEY_MODERATOR, "manager"},
+	})
+	public := &Channel{Uuid: "public", Type: CHANNEL_TYPE_TEXT}
+	private := &Channel{Uuid: "private", Type: CHANNEL_TYPE_TEXT, Private: true}
+	ordered := &Channel{Uuid: "ordered", Type: CHANNEL_TYPE_TEXT}
+	dm := &Channel{Uuid: "dm", Type: CHANNEL_TYPE_DM}
+	p.addMember("private", "member")
+	p.addMember("dm", "user")
+	p.addMember("dm", "admin")
+
+	// The member role loses SEND_MESSAGES, moderators get it back, then
+	// the overrides of single users apply last.
+	p.overrides["ordered"] = []*ChannelOverride{
+		{ChannelUuid: "ordered", TargetUuid: ROLE_KEY_MEMBER, Deny: PERMISSION_SEND_MESSAGES},
+		{ChannelUuid: "ordered", TargetUuid: ROLE_KEY_MODERATOR, Allow: PERMISSION_SEND_MESSAGES},
+		{ChannelUuid: "ordered", TargetUuid: "manager", Deny: PERMISSION_SEND_MESSAGES | PERMISSION_MANAGE_ROLES},
+		{ChannelUuid: "ordered", TargetUuid: "muted", Deny: PERMISSION_SEND_MESSAGES},
+		{ChannelUuid: "ordered", TargetUuid: "allowed", Allow: PERMISSION_SEND_MESSAGES},
+	}
+
+	member := PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES | PERMISSION_UPLOAD_FILES
+	moderator := member | PERMISSION_MANAGE_MESSAGES | PERMISSION_KICK_MEMBERS | PERMISSION_MENTION_EVERYONE
+	manager := member | PERMISSION_MANAGE_ROLES | PERMISSION_MANAGE_CHANNELS
+
+	cases := []struct {
+		name     string
+		userUuid string
+		channel  *Channel
+		want     Permission
+	}{
+		{"member server-wide", "user", nil, member},
+		{"moderator server-wide", "mod", nil, moderator},
+		{"roles add up", "manager", nil, manager},
+		{"administrator server-wide", "admin", nil, PERMISSION_ALL},
+		{"owner server-wide", "owner", nil, PERMISSION_ALL},
+		{"member in a public channel", "user", public, member},
+
+		{"non member of a private channel", "user", private, 0},
+		{"moderator not member of a private channel", "mod", private, 0},
+		{"member of a private channel", "member", private, member},
+		{"administrator bypasses private channels", "admin", private, PERMISSION_ALL},
+
+		{"direct message participant", "user", dm, member},
+		{"direct message outsider", "mod", dm, 0},
+		{"administrator outside a direct message", "owner", dm, 0},
+		{"administrator in a direct message", "admin", dm, PERMISSION_DIRECT_MESSAGES},
+
+		{"member role override", "user", ordered, member &^ PERMISSION_SEND_MESSAGES},
+		{"role override after the member role", "mod", ordered, moderator},
+		{"role override denying", "manager", ordered, manager &^ PERMISSION_SEND_MESSAGES &^ PERMISSION_MANAGE_ROLES},
+		{"allows of other roles win over their denies", "quiet", ordered, moderator | PERMISSION_MANAGE_CHANNELS},
+		{"user override after role overrides", "muted", ordered, moderator &^ PERMISSION_SEND_MESSAGES},
+		{"user override after the member role", "allowed", ordered, member},
+		{"administrator ignores overrides", "admin", ordered, PERMISSION_ALL},
+	}
+	for _, c := range cases {
+		if got := p.compute(c.userUuid, c.channel); got != c.want {
+			t.Errorf("%s: got %b, want %b", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type UserStatus string
+
+const (
+	USER_STATUS_ONLINE    UserStatus = "online"
+	USER_STATUS_IDLE      UserStatus = "idle"
+	USER_STATUS_DND       UserStatus = "dnd"
+	USER_STATUS_INVISIBLE UserStatus = "invisible"
+	// USER_STATUS_OFFLINE is never stored, it is what others see of
+	// disconnected and invisible users.
+	USER_STATUS_OFFLINE UserStatus = "offline"
+)
+
+const (
+	CUSTOM_STATUS_MAX_LENGTH       = 128
+	CUSTOM_STATUS_EMOJI_MAX_LENGTH = 32
+	PRESENCE_EXPIRY_INTERVAL       = 30 * time.Second
+)
+
+// Presence is the status of a user as shown to other users.
+type Presence struct {
+	UserUuid            string     `json:"userUuid"`
+	Status              UserStatus `json:"status"`
+	CustomStatus        string     `json:"customStatus,omitempty"`
+	CustomStatusEmoji   string     `json:"customStatusEmoji,omitempty"`
+	CustomStatusExpires time.Time  `json:"customStatusExpires"`
+}
+
+func OfflinePresence(userUuid string) Presence {
+	return Presence{
+		UserUuid: userUuid,
+		Status:   USER_STATUS_OFFLINE,
+	}
+}
+
+// VisibleTo returns the presence as seen by the given user, invisible users
+// appear offline to everyone but themselves.
+func (p Presence) VisibleTo(viewerUuid string) Presence {
+	if p.Status == USER_STATUS_INVISIBLE && p.UserUuid != viewerUuid {
+		return OfflinePresence(p.UserUuid)
+	}
+	return p
+}
+
+func (p Presence) IsOnline() bool {
+	return p.Status != USER_STATUS_OFFLINE
+}
+
+// UserConnections holds the connections of a user and the status it chose,
+// it is only accessed by the hub goroutine.
+type UserConnections struct {
+	clients             map[*Client]bool
+	status              UserStatus
+	customStatus        string
+	customStatusEmoji   string
+	customStatusExpires time.Time
+	last                Presence
+}
+
+func NewUserConnections(user *User) *UserConnections {
+	return &UserConnections{
+		clients:             make(map[*Client]bool),
+		status:              user.Status,
+		customStatus:        user.CustomStatus,
+		customStatusEmoji:   user.CustomStatusEmoji,
+		customStatusExpires: user.CustomStatusExpires,
+	}
+}
+
+// Presence returns the real presence of the user, idle when every
+// connection reported inactivity.
+func (uc *UserConnections) Presence(userUuid string, now time.Time) Presence {
+	presence := Presence{
+		UserUuid: userUuid,
+		Status:   uc.status,
+	}
+	if len(presence.Status) == 0 {
+		presence.Status = USER_STATUS_ONLINE
+	}
+
+	if presence.Status == USER_STATUS_ONLINE {
+		idle := true
+		for c := range uc.clients {
+			idle = idle && c.Idle
+		}
+		if idle {
+			presence.Status = USER_STATUS_IDLE
+		}
+	}
+
+	if uc.customStatusExpires.IsZero() || uc.customStatusExpires.After(now) {
+		presence.CustomStatus = uc.customStatus
+		presence.CustomStatusEmoji = uc.customStatusEmoji
+		presence.CustomStatusExpires = uc.customStatusExpires
+	}
+
+	return presence
+}
+
+// PresenceWrites holds the online state of users waiting to be persisted,
+// only the latest state of each user matters so setting one never blocks.
+type PresenceWrites struct {
+	mux     sync.Mutex
+	pending map[string]bool
+	Notify  chan struct{}
+}
+
+func NewPresenceWrites() *PresenceWrites {
+	return &PresenceWrites{
+		pending: make(map[string]bool),
+		Notify:  make(chan struct{}, 1),
+	}
+}
+
+func (writes *PresenceWrites) Set(userUuid string, online bool) {
+	writes.mux.Lock()
+	writes.pending[userUuid] = online
+	writes.mux.Unlock()
+
+	select {
+	case writes.Notify <- struct{}{}:
+	default:
+	}
+}
+
+// PopAll returns the pending states and forgets them.
+func (writes *PresenceWrites) PopAll() map[string]bool {
+	writes.mux.Lock()
+	defer writes.mux.Unlock()
+
+	pending := writes.pending
+	writes.pending = make(map[string]bool)
+	return pending
+}
+
+type StatusUpdate struct {
+	client  *Client
+	request PacketSetStatusRequest
+}
+
+type IdleUpdate struct {
+	client *Client
+	idle   bool
+}
+
+type PresencesRequest struct {
+	viewerUuid string
+	reply      chan map[string]Presence
+}
+
+// GetPresences returns the presence of every connected user as seen by the
+// viewer, users missing from the map are offline.
+func (hub *Hub) GetPresences(viewerUuid string) map[string]Presence {
+	reply := make(chan map[string]Presence)
+	hub.Presences <- PresencesRequest{
+		viewerUuid,
+		reply,
+	}
+	return <-reply
+}
+
+// PresenceGoroutine persists the latest presence of users, without making
+// the hub wait for the database.
+func (hub *Hub) PresenceGoroutine() {
+	for range hub.Presence.Notify {
+		for userUuid, online := range hub.Presence.PopAll() {
+			_, err := hub.Server.Db.Exec("UPDATE users SET online = ? WHERE uuid = ?", online, userUuid)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+type PacketSetStatusRequest struct {
+	Status              UserStatus `json:"status"`
+	CustomStatus        string     `json:"customStatus"`
+	CustomStatusEmoji   string     `json:"customStatusEmoji"`
+	CustomStatusExpires time.Time  `json:"customStatusExpires"`
+}
+
+func (p *PacketSetStatusRequest) Validate() error {
+	switch p.Status {
+	case USER_STATUS_ONLINE, USER_STATUS_IDLE, USER_STATUS_DND, USER_STATUS_INVISIBLE:
+	default:
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "status must be one of online, idle, dnd or invisible")
+	}
+	if !utf8.ValidString(p.CustomStatus) || utf8.RuneCountInString(p.CustomStatus) > CUSTOM_STATUS_MAX_LENGTH {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "customStatus can't be longer than %d characters", CUSTOM_STATUS_MAX_LENGTH)
+	}
+	if !utf8.ValidString(p.CustomStatusEmoji) || utf8.RuneCountInString(p.CustomStatusEmoji) > CUSTOM_STATUS_EMOJI_MAX_LENGTH {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "customStatusEmoji can't be longer than %d characters", CUSTOM_STATUS_EMOJI_MAX_LENGTH)
+	}
+	if !p.CustomStatusExpires.IsZero() && p.CustomStatusExpires.Before(time.Now()) {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "customStatusExpires must be in the future")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type OverflowPolicy int
+
+const (
+	// OVERFLOW_POLICY_DISCONNECT disconnects a client as soon as its queue is
+	// full.
+	OVERFLOW_POLICY_DISCONNECT OverflowPolicy = iota
+	// OVERFLOW_POLICY_DROP_TYPING makes room by dropping the oldest queued
+	// typing packet, and only disconnects when there is none left to drop.
+	OVERFLOW_POLICY_DROP_TYPING
+)
+
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "", "drop_typing":
+		return OVERFLOW_POLICY_DROP_TYPING, nil
+	case "disconnect":
+		return OVERFLOW_POLICY_DISCONNECT, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// PacketQueue is a bounded queue of packets waiting to be written to a
+// client. Pushing never blocks so the hub can't be stalled by a slow client.
+type PacketQueue struct {
+	mux     sync.Mutex
+	packets []Packet
+	size    int
+	policy  OverflowPolicy
+	// closed is set once the queue overflowed, the client is being
+	// disconnected and no more packets are accepted.
+	closed bool
+	Notify chan struct{}
+}
+
+func NewPacketQueue(size int, policy OverflowPolicy) *PacketQueue {
+	return &PacketQueue{
+		packets: make([]Packet, 0, size),
+		size:    size,
+		policy:  policy,
+		Notify:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues the packet and returns how many packets were dropped to make
+// room for it. ok is false if this packet overflowed the queue, which closes
+// it: later packets are ignored and ok is only false once.
+func (queue *PacketQueue) Push(packet Packet) (dropped int, ok bool) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	if queue.closed {
+		return 0, true
+	}
+
+	if len(queue.packets) >= queue.size {
+		if queue.policy != OVERFLOW_POLICY_DROP_TYPING {
+			queue.closed = true
+			return 0, false
+		}
+		if packet.Type == PACKET_TYPE_TYPING {
+			return 1, true
+		}
+
+		i := queue.indexOfType(PACKET_TYPE_TYPING)
+		if i < 0 {
+			queue.closed = true
+			return 0, false
+		}
+		queue.packets = append(queue.packets[:i], queue.packets[i+1:]...)
+		dropped = 1
+	}
+
+	queue.packets = append(queue.packets, packet)
+
+	select {
+	case queue.Notify <- struct{}{}:
+	default:
+	}
+
+	return dropped, true
+}
+
+// PopAll empties the queue and returns its packets in order.
+func (queue *PacketQueue) PopAll() []Packet {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	packets := queue.packets
+	queue.packets = make([]Packet, 0, queue.size)
+	return packets
+}
+
+func (queue *PacketQueue) Len() int {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+	return len(queue.packets)
+}
+
+func (queue *PacketQueue) indexOfType(packetType PacketType) int {
+	for i, packet := range queue.packets {
+		if packet.Type == packetType {
+			return i
+		}
+	}
+	return -1
+}
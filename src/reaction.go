@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-pg/pg/v10"
+)
+
+const (
+	REACTION_EMOJI_MAX_LENGTH = 32
+	MESSAGE_MAX_REACTIONS     = 20
+)
+
+// Reaction is an emoji added to a message by a user, each user can only add
+// a given emoji once to a message.
+type Reaction struct {
+	MessageUuid string    `pg:",pk" json:"messageUuid"`
+	UserUuid    string    `pg:",pk" json:"userUuid"`
+	Emoji       string    `pg:",pk" json:"emoji"`
+	Date        time.Time `json:"date"`
+}
+
+// ReactionCount is sent along with messages, Me tells whether the user
+// reading the message added the reaction.
+type ReactionCount struct {
+	MessageUuid string `json:"-"`
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	Me          bool   `json:"me"`
+}
+
+// PacketReactionRequest adds or removes a reaction. Emoji is either a
+// unicode emoji or the id of a custom emoji.
+type PacketReactionRequest struct {
+	MessageUuid string `json:"messageUuid"`
+	Emoji       string `json:"emoji"`
+}
+
+func (p *PacketReactionRequest) Validate() error {
+	err := validateUuid("messageUuid", p.MessageUuid)
+	if err != nil {
+		return err
+	}
+	length := utf8.RuneCountInString(p.Emoji)
+	if !utf8.ValidString(p.Emoji) || length == 0 || length > REACTION_EMOJI_MAX_LENGTH || strings.IndexFunc(p.Emoji, unicode.IsSpace) >= 0 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "emoji must be 1 to %d characters without spaces", REACTION_EMOJI_MAX_LENGTH)
+	}
+	return nil
+}
+
+type PacketReaction struct {
+	MessageUuid string `json:"messageUuid"`
+	ChannelUuid string `json:"channelUuid"`
+	UserUuid    string `json:"userUuid"`
+	Emoji       string `json:"emoji"`
+}
+
+// LoadReactions fills the reaction counts of the messages as seen by the
+// given user, in the order the reactions were first added.
+func (server *Server) LoadReactions(messages []Message, viewerUuid string) error {
+	messageUuids := []string{}
+	for _, message := range messages {
+		messageUuids = append(messageUuids, message.Uuid)
+	}
+	if len(messageUuids) == 0 {
+		return nil
+	}
+
+	var counts []ReactionCount
+	_, err := server.Db.Query(&counts, `SELECT message_uuid, emoji, count(*) AS count, bool_or(user_uuid = ?) AS me
+		FROM reactions
+		WHERE message_uuid IN (?)
+		GROUP BY message_uuid, emoji
+		ORDER BY min(date) ASC`, viewerUuid, pg.In(messageUuids))
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		for _, count := range counts {
+			if count.MessageUuid == messages[i].Uuid {
+				messages[i].Reactions = append(messages[i].Reactions, count)
+			}
+		}
+	}
+	return nil
+}
+
+// SetReaction adds or removes the reaction of the user and returns the
+// message it applies to.
+func (server *Server) SetReaction(userUuid string, request PacketReactionRequest, add bool) (*Message, error) {
+	message := &Message{
+		Uuid: request.MessageUuid,
+	}
+	err := server.Db.Model(message).WherePK().Column("uuid", "channel_uuid", "user_uuid", "thread_uuid").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", request.MessageUuid)
+		}
+		return nil, err
+	}
+
+	err = server.Authorize(userUuid, message.ChannelUuid, PERMISSION_VIEW_CHANNEL|PERMISSION_SEND_MESSAGES)
+	if err != nil {
+		return nil, err
+	}
+
+	reaction := &Reaction{
+		MessageUuid: message.Uuid,
+		UserUuid:    userUuid,
+		Emoji:       request.Emoji,
+		Date:        time.Now(),
+	}
+
+	var r pg.Result
+	if add {
+		var emojis int
+		_, err = server.Db.QueryOne(pg.Scan(&emojis), "SELECT count(DISTINCT emoji) FROM reactions WHERE message_uuid = ? AND emoji != ?", message.Uuid, request.Emoji)
+		if err != nil {
+			return nil, err
+		}
+		if emojis >= MESSAGE_MAX_REACTIONS {
+			return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "message can't have more than %d different reactions", MESSAGE_MAX_REACTIONS)
+		}
+		r, err = server.Db.Model(reaction).OnConflict("DO NOTHING").Insert()
+	} else {
+		r, err = server.Db.Model(reaction).WherePK().Delete()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.RowsAffected() == 0 {
+		// Nothing changed, there is nothing to broadcast either.
+		return nil, nil
+	}
+
+	return message, nil
+}
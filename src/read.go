@@ -0,0 +1,183 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// ReadState is the last message a user read in a channel, messages posted
+// after it are unread.
+type ReadState struct {
+	UserUuid     string    `pg:",pk" json:"-"`
+	ChannelUuid  string    `pg:",pk" json:"channelUuid"`
+	MessageUuid  string    `json:"messageUuid"`
+	MessageDate  time.Time `json:"messageDate"`
+	MentionCount int       `pg:"-" json:"mentionCount"`
+}
+
+// PacketReadRequest moves the read marker of the channel to the message.
+type PacketReadRequest struct {
+	ChannelUuid string `json:"channelUuid"`
+	MessageUuid string `json:"messageUuid"`
+}
+
+func (p *PacketReadRequest) Validate() error {
+	err := validateUuid("channelUuid", p.ChannelUuid)
+	if err != nil {
+		return err
+	}
+	return validateUuid("messageUuid", p.MessageUuid)
+}
+
+// ChannelUnread is a channel as listed to a user, along with what the user
+// hasn't read in it yet.
+type ChannelUnread struct {
+	Channel
+	LastReadUuid string `json:"lastReadUuid,omitempty"`
+	UnreadCount  int    `json:"unreadCount"`
+	MentionCount int    `json:"mentionCount"`
+}
+
+type channelCount struct {
+	ChannelUuid string
+	Count       int
+}
+
+// MarkRead moves the read marker of the user forward to the message, a
+// marker never moves back so that devices reading out of order agree. The
+// resulting read state is sent to every connection of the user.
+func (server *Server) MarkRead(userUuid string, request PacketReadRequest) (*ReadState, error) {
+	if server.GetChannelByUuid(request.ChannelUuid) == nil {
+		return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", request.ChannelUuid)
+	}
+	err := server.Authorize(userUuid, request.ChannelUuid, PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{
+		Uuid: request.MessageUuid,
+	}
+	err = server.Db.Model(message).WherePK().Where("channel_uuid = ?", request.ChannelUuid).Column("uuid", "date").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "unknown message %s", request.MessageUuid)
+		}
+		return nil, err
+	}
+
+	state := &ReadState{
+		UserUuid:    userUuid,
+		ChannelUuid: request.ChannelUuid,
+		MessageUuid: message.Uuid,
+		MessageDate: message.Date,
+	}
+	_, err = server.Db.Model(state).
+		OnConflict("(user_uuid, channel_uuid) DO UPDATE").
+		Set("message_uuid = EXCLUDED.message_uuid, message_date = EXCLUDED.message_date").
+		Where("read_state.message_date < EXCLUDED.message_date").
+		Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading past a mention reads the mention too.
+	_, err = server.Db.Model((*Mention)(nil)).Set("read = true").
+		Where("user_uuid = ?", userUuid).
+		Where("channel_uuid = ?", request.ChannelUuid).
+		Where("date <= ?", message.Date).
+		Update()
+	if err != nil {
+		return nil, err
+	}
+
+	// The marker may have been further already.
+	err = server.Db.Model(state).WherePK().Select()
+	if err != nil {
+		return nil, err
+	}
+	_, err = server.Db.QueryOne(pg.Scan(&state.MentionCount), `SELECT count(*) FROM mentions
+		WHERE user_uuid = ? AND channel_uuid = ? AND NOT coalesce(read, false)
+			AND message_uuid IN (SELECT uuid FROM messages WHERE deleted IS NULL)`, userUuid, request.ChannelUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	server.Hub.UserBroadcast <- UserPacket{
+		[]string{userUuid},
+		Packet{
+			Type: PACKET_TYPE_READ,
+			Data: state,
+		},
+	}
+
+	return state, nil
+}
+
+// LoadUnread returns the channels along with the read marker, the number of
+// unread messages and of unread mentions of the user in each.
+func (server *Server) LoadUnread(userUuid string, channels []Channel) ([]ChannelUnread, error) {
+	unread := make([]ChannelUnread, 0, len(channels))
+	if len(channels) == 0 {
+		return unread, nil
+	}
+	channelUuids := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		channelUuids = append(channelUuids, channel.Uuid)
+	}
+
+	var states []ReadState
+	err := server.Db.Model(&states).
+		Where("user_uuid = ?", userUuid).
+		Where("channel_uuid IN (?)", pg.In(channelUuids)).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	// Thread replies and the user's own messages don't count as unread.
+	var unreadCounts []channelCount
+	_, err = server.Db.Query(&unreadCounts, `SELECT m.channel_uuid, count(*) AS count
+		FROM messages m
+		LEFT JOIN read_states r ON r.channel_uuid = m.channel_uuid AND r.user_uuid = ?
+		WHERE m.channel_uuid IN (?) AND m.thread_uuid IS NULL AND m.user_uuid != ? AND m.deleted IS NULL
+			AND (r.message_date IS NULL OR m.date > r.message_date)
+		GROUP BY m.channel_uuid`, userUuid, pg.In(channelUuids), userUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	var mentionCounts []channelCount
+	_, err = server.Db.Query(&mentionCounts, `SELECT channel_uuid, count(*) AS count
+		FROM mentions
+		WHERE user_uuid = ? AND channel_uuid IN (?) AND NOT coalesce(read, false)
+			AND message_uuid IN (SELECT uuid FROM messages WHERE deleted IS NULL)
+		GROUP BY channel_uuid`, userUuid, pg.In(channelUuids))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, channel := range channels {
+		channelUnread := ChannelUnread{
+			Channel: channel,
+		}
+		for _, state := range states {
+			if state.ChannelUuid == channel.Uuid {
+				channelUnread.LastReadUuid = state.MessageUuid
+			}
+		}
+		for _, count := range unreadCounts {
+			if count.ChannelUuid == channel.Uuid {
+				channelUnread.UnreadCount = count.Count
+			}
+		}
+		for _, count := range mentionCounts {
+			if count.ChannelUuid == channel.Uuid {
+				channelUnread.MentionCount = count.Count
+			}
+		}
+		unread = append(unread, channelUnread)
+	}
+	return unread, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DELETED_MESSAGES_MAX_COUNT = 100
+)
+
+// MessageRevision is a previous content of an edited message, Date is when
+// that content was posted or last edited.
+type MessageRevision struct {
+	MessageUuid string    `pg:",pk" json:"messageUuid"`
+	Date        time.Time `pg:",pk" json:"date"`
+	Content     string    `json:"content"`
+}
+
+// MessageTombstone is broadcast in place of a deleted message, moderators can
+// restore it until it is purged.
+type MessageTombstone struct {
+	Uuid        string    `json:"uuid"`
+	ChannelUuid string    `json:"channelUuid"`
+	ThreadUuid  string    `json:"threadUuid,omitempty"`
+	Deleted     time.Time `json:"deleted"`
+	DeletedBy   string    `json:"deletedBy"`
+	// ThreadDeleted tells that the replies were deleted along with the
+	// thread root, they are kept otherwise.
+	ThreadDeleted bool `json:"threadDeleted,omitempty"`
+}
+
+// EditMessage replaces the content of a message of the user, the previous
+// content is kept as a revision. The author must still be allowed to send
+// messages in the channel.
+func (server *Server) EditMessage(userUuid string, request PacketEditMessageRequest) (*Message, error) {
+	message := &Message{
+		Uuid: request.MessageUuid,
+	}
+	err := server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		err := tx.Model(message).WherePK().Where("user_uuid = ?", userUuid).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+
+		channel := server.GetChannelByUuid(message.ChannelUuid)
+		if channel == nil {
+			return NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", message.ChannelUuid)
+		}
+		err = server.Authorize(userUuid, channel.Uuid, PERMISSION_VIEW_CHANNEL|PERMISSION_SEND_MESSAGES)
+		if err != nil {
+			return err
+		}
+
+		revision := &MessageRevision{
+			MessageUuid: message.Uuid,
+			Date:        message.Date,
+			Content:     message.Content,
+		}
+		if !message.Edited.IsZero() {
+			revision.Date = message.Edited
+		}
+		_, err = tx.Model(revision).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+
+		message.Content = request.Content
+		message.Edited = time.Now()
+		_, err = tx.Model(message).WherePK().Column("content", "edited").Update()
+		return err
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", request.MessageUuid)
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// DeleteMessage soft deletes the message. Authors can delete their own
+// messages in the channels they can view. Deleting a thread root also
+// deletes its replies when the actor manages messages, otherwise the replies
+// are kept and the root stays in the channel as a tombstone.
+func (server *Server) DeleteMessage(actorUuid string, messageUuid string) (*MessageTombstone, error) {
+	message := &Message{
+		Uuid: messageUuid,
+	}
+	err := server.Db.Model(message).WherePK().Column("channel_uuid", "user_uuid", "thread_uuid").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", messageUuid)
+		}
+		return nil, err
+	}
+
+	// Authors who can't view the channel anymore can't delete their
+	// messages there either.
+	err = server.Authorize(actorUuid, message.ChannelUuid, PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		return nil, err
+	}
+	err = server.Authorize(actorUuid, message.ChannelUuid, PERMISSION_MANAGE_MESSAGES)
+	moderator := err == nil
+	if message.UserUuid != actorUuid && !moderator {
+		return nil, err
+	}
+
+	tombstone := &MessageTombstone{
+		Uuid:        messageUuid,
+		ChannelUuid: message.ChannelUuid,
+		ThreadUuid:  message.ThreadUuid,
+		Deleted:     time.Now(),
+		DeletedBy:   actorUuid,
+		// Replies go away with the thread they were posted in, but authors
+		// can't delete the replies of others.
+		ThreadDeleted: len(message.ThreadUuid) == 0 && moderator,
+	}
+	query := server.Db.Model((*Message)(nil)).
+		Set("deleted = ?, deleted_by = ?", tombstone.Deleted, actorUuid)
+	if tombstone.ThreadDeleted {
+		query.Where("uuid = ? OR thread_uuid = ?", messageUuid, messageUuid)
+	} else {
+		query.Where("uuid = ?", messageUuid)
+	}
+	r, err := query.Update()
+	if err != nil {
+		return nil, err
+	}
+	if r.RowsAffected() == 0 {
+		return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", messageUuid)
+	}
+
+	return tombstone, nil
+}
+
+// RestoreMessage undoes the deletion of a message and of the replies deleted
+// along with it.
+func (server *Server) RestoreMessage(actorUuid string, channelUuid string, messageUuid string) (*Message, error) {
+	err := server.Authorize(actorUuid, channelUuid, PERMISSION_MANAGE_MESSAGES)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{
+		Uuid: messageUuid,
+	}
+	err = server.Db.Model(message).WherePK().Where("channel_uuid = ?", channelUuid).Deleted().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "deleted message %s not found", messageUuid)
+		}
+		return nil, err
+	}
+	if len(message.ThreadUuid) > 0 {
+		_, err = server.GetThreadRoot(channelUuid, message.ThreadUuid)
+		if err != nil {
+			return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "the thread of message %s must be restored first", messageUuid)
+		}
+	}
+
+	_, err = server.Db.Model((*Message)(nil)).
+		Set("deleted = NULL, deleted_by = NULL").
+		Where("uuid = ? OR (thread_uuid = ? AND deleted = ?)", messageUuid, messageUuid, *message.Deleted).
+		AllWithDeleted().
+		Update()
+	if err != nil {
+		return nil, err
+	}
+
+	message.Deleted = nil
+	message.DeletedBy = ""
+	return message, nil
+}
+
+// GetDeletedMessages returns the messages of the channel which can still be
+// restored, most recently deleted first.
+func (server *Server) GetDeletedMessages(actorUuid string, channelUuid string) ([]Message, error) {
+	err := server.Authorize(actorUuid, channelUuid, PERMISSION_MANAGE_MESSAGES)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	err = server.Db.Model(&messages).
+		Where("channel_uuid = ?", channelUuid).
+		Deleted().
+		Order("deleted DESC").
+		Limit(DELETED_MESSAGES_MAX_COUNT).
+		Select()
+	return messages, err
+}
+
+// GetMessageRevisions returns the previous contents of the message, oldest
+// first.
+func (server *Server) GetMessageRevisions(actorUuid string, channelUuid string, messageUuid string) ([]MessageRevision, error) {
+	err := server.Authorize(actorUuid, channelUuid, PERMISSION_MANAGE_MESSAGES)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := server.Db.Model((*Message)(nil)).
+		Where("uuid = ? AND channel_uuid = ?", messageUuid, channelUuid).
+		AllWithDeleted().
+		Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", messageUuid)
+	}
+
+	revisions := []MessageRevision{}
+	err = server.Db.Model(&revisions).Where("message_uuid = ?", messageUuid).Order("date ASC").Select()
+	return revisions, err
+}
+
+// PurgeDeletedMessages permanently deletes the messages deleted longer than
+// the retention ago.
+func (server *Server) PurgeDeletedMessages() {
+	for {
+		var purged int
+		err := server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+			before := time.Now().Add(-server.DeletedMessageRetention)
+			for _, table := range []string{"reactions", "mentions", "message_revisions"} {
+				_, err := tx.Exec("DELETE FROM ? WHERE message_uuid IN (SELECT uuid FROM messages WHERE deleted <= ?)", pg.Ident(table), before)
+				if err != nil {
+					return err
+				}
+			}
+			r, err := tx.Model((*Message)(nil)).Where("deleted <= ?", before).ForceDelete()
+			if err != nil {
+				return err
+			}
+			purged = r.RowsAffected()
+			return nil
+		})
+		if err != nil {
+			log.Print(err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted message(s)", purged)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (s *Server) HttpGetDeletedMessages(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	messages, err := s.GetDeletedMessages(userUuid, channelUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(messages)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpGetMessageRevisions(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	messageUuid := ctx.UserValue("messageUuid")
+	if channelUuid == nil || messageUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	revisions, err := s.GetMessageRevisions(userUuid, channelUuid.(string), messageUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(revisions)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpRestoreMessage(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	messageUuid := ctx.UserValue("messageUuid")
+	if channelUuid == nil || messageUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	message, err := s.RestoreMessage(userUuid, channelUuid.(string), messageUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	go func() {
+		err := s.broadcastMessage(message, Packet{
+			Type: PACKET_TYPE_RESTORE_MESSAGE,
+			Data: message,
+		})
+		if err == nil && len(message.ThreadUuid) > 0 {
+			err = s.refreshThread(message)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	json, err := json.Marshal(message)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
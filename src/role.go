@@ -0,0 +1,782 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+// Role grants permissions to the users it is assigned to. Built-in roles
+// have a key, the member role is implicitly given to everyone.
+type Role struct {
+	Uuid        string     `json:"uuid"`
+	Key         string     `json:"key,omitempty"`
+	Name        string     `json:"name"`
+	Permissions Permission `json:"permissions"`
+	Position    int        `json:"position"`
+}
+
+type UserRole struct {
+	UserUuid string `pg:",pk"`
+	RoleUuid string `pg:",pk"`
+}
+
+const (
+	ROLE_NAME_MAX_LENGTH = 32
+)
+
+// builtinRoles are created on startup when missing.
+var builtinRoles = []Role{
+	{
+		Key:         ROLE_KEY_OWNER,
+		Name:        "Owner",
+		Permissions: PERMISSION_ALL,
+		Position:    1000,
+	},
+	{
+		Key:         ROLE_KEY_ADMIN,
+		Name:        "Admin",
+		Permissions: PERMISSION_ADMINISTRATOR,
+		Position:    900,
+	},
+	{
+		Key:  ROLE_KEY_MODERATOR,
+		Name: "Moderator",
+		Permissions: PERMISSION_MANAGE_MESSAGES | PERMISSION_KICK_MEMBERS | PERMISSION_MENTION_EVERYONE |
+			PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES | PERMISSION_UPLOAD_FILES,
+		Position: 500,
+	},
+	{
+		Key:         ROLE_KEY_MEMBER,
+		Name:        "Member",
+		Permissions: PERMISSION_VIEW_CHANNEL | PERMISSION_SEND_MESSAGES | PERMISSION_UPLOAD_FILES,
+		Position:    0,
+	},
+}
+
+func createBuiltinRoles(db *pg.DB) error {
+	for _, builtinRole := range builtinRoles {
+		var exists bool
+		_, err := db.QueryOne(pg.Scan(&exists), "SELECT EXISTS(SELECT 1 FROM roles WHERE key = ?)", builtinRole.Key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		role := builtinRole
+		role.Uuid = uuid.New().String()
+		_, err = db.Model(&role).Insert()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureOwner gives the owner role to the user with the given login when
+// nobody owns the server yet.
+func (server *Server) EnsureOwner(login string) error {
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	owner := p.roleByKey(ROLE_KEY_OWNER)
+	for _, roleUuids := range p.userRoles {
+		for _, roleUuid := range roleUuids {
+			if roleUuid == owner.Uuid {
+				return nil
+			}
+		}
+	}
+
+	var userUuid string
+	if len(login) > 0 {
+		_, err := server.Db.QueryOne(pg.Scan(&userUuid), "SELECT uuid FROM users WHERE lower(login) = lower(?)", login)
+		if err != nil && err != pg.ErrNoRows {
+			return err
+		}
+	} else {
+		// Fresh installs have a single user, the one who just registered.
+		var count int
+		_, err := server.Db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM users")
+		if err != nil {
+			return err
+		}
+		if count == 1 {
+			_, err = server.Db.QueryOne(pg.Scan(&userUuid), "SELECT uuid FROM users")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(userUuid) == 0 {
+		return nil
+	}
+
+	_, err := server.Db.Model(&UserRole{userUuid, owner.Uuid}).Insert()
+	if err != nil {
+		return err
+	}
+	p.userRoles[userUuid] = append(p.userRoles[userUuid], owner.Uuid)
+
+	return nil
+}
+
+func (server *Server) GetRoles() []Role {
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	roles := make([]Role, 0, len(server.Permissions.roles))
+	for _, role := range server.Permissions.roles {
+		roles = append(roles, *role)
+	}
+	return roles
+}
+
+func (server *Server) GetUserRoleUuids(userUuid string) []string {
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	return append([]string{}, server.Permissions.userRoles[userUuid]...)
+}
+
+// canManage checks that the actor is allowed to manage roles, and that the
+// role position and permissions stay below its own.
+func (p *Permissions) canManage(actorUuid string, position int, permissions Permission) error {
+	if p.isOwner(actorUuid) {
+		return nil
+	}
+	actorPermissions := p.compute(actorUuid, nil)
+	if actorPermissions&PERMISSION_MANAGE_ROLES == 0 {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "missing permission")
+	}
+	if position >= p.highestPosition(actorUuid) {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "role is above your highest role")
+	}
+	if permissions&^actorPermissions != 0 {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "can't grant permissions you don't have")
+	}
+	return nil
+}
+
+// canOverride checks that the actor manages both roles and the channel, that
+// the override only allows or denies permissions the actor has there, and
+// that it targets a role or a user below its highest role.
+func (p *Permissions) canOverride(actorUuid string, channel *Channel, override ChannelOverride) error {
+	actorPermissions := p.compute(actorUuid, channel)
+	if actorPermissions&(PERMISSION_MANAGE_ROLES|PERMISSION_MANAGE_CHANNELS) != PERMISSION_MANAGE_ROLES|PERMISSION_MANAGE_CHANNELS {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "missing permission")
+	}
+	if p.isOwner(actorUuid) {
+		return nil
+	}
+	if (override.Allow|override.Deny)&^actorPermissions != 0 {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "can't grant permissions you don't have")
+	}
+	position := p.highestPosition(override.TargetUuid)
+	if role := p.roleByUuid(override.TargetUuid); role != nil {
+		position = role.Position
+	}
+	if position >= p.highestPosition(actorUuid) {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "target is above your highest role")
+	}
+	return nil
+}
+
+type RoleRequest struct {
+	Name        *string
+	Permissions *Permission
+	Position    *int
+}
+
+func (r *RoleRequest) Validate() error {
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if len(name) == 0 || !utf8.ValidString(name) || utf8.RuneCountInString(name) > ROLE_NAME_MAX_LENGTH {
+			return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name must be 1 to %d characters", ROLE_NAME_MAX_LENGTH)
+		}
+		r.Name = &name
+	}
+	if r.Permissions != nil && *r.Permissions&^PERMISSION_ALL != 0 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "unknown permissions")
+	}
+	if r.Position != nil && *r.Position < 1 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "position must be positive")
+	}
+	return nil
+}
+
+func (server *Server) CreateRole(actorUuid string, request RoleRequest) (*Role, error) {
+	if request.Name == nil {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name is required")
+	}
+	err := request.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	role := &Role{
+		Uuid:     uuid.New().String(),
+		Name:     *request.Name,
+		Position: 1,
+	}
+	if request.Permissions != nil {
+		role.Permissions = *request.Permissions
+	}
+	if request.Position != nil {
+		role.Position = *request.Position
+	}
+
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	err = p.canManage(actorUuid, role.Position, role.Permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = server.Db.Model(role).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	p.roles = append(p.roles, role)
+	server.broadcastRoles()
+
+	return role, nil
+}
+
+func (server *Server) UpdateRole(actorUuid string, roleUuid string, request RoleRequest) (*Role, error) {
+	err := request.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	current := p.roleByUuid(roleUuid)
+	if current == nil {
+		return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "unknown role %s", roleUuid)
+	}
+	if current.Key == ROLE_KEY_OWNER || (current.Key != "" && request.Position != nil) {
+		return nil, NewPacketError(ERROR_CODE_FORBIDDEN, "built-in role can't be changed this way")
+	}
+
+	role := *current
+	if request.Name != nil {
+		role.Name = *request.Name
+	}
+	if request.Permissions != nil {
+		role.Permissions = *request.Permissions
+	}
+	if request.Position != nil {
+		role.Position = *request.Position
+	}
+
+	err = p.canManage(actorUuid, current.Position, role.Permissions)
+	if err == nil {
+		err = p.canManage(actorUuid, role.Position, role.Permissions)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = server.Db.Model(&role).WherePK().Column("name", "permissions", "position").Update()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range p.roles {
+		if p.roles[i].Uuid == role.Uuid {
+			p.roles[i] = &role
+		}
+	}
+	server.broadcastRoles()
+
+	return &role, nil
+}
+
+func (server *Server) DeleteRole(actorUuid string, roleUuid string) error {
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	role := p.roleByUuid(roleUuid)
+	if role == nil {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown role %s", roleUuid)
+	}
+	if len(role.Key) > 0 {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "built-in roles can't be deleted")
+	}
+	err := p.canManage(actorUuid, role.Position, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	_, err = server.Db.Exec("DELETE FROM user_roles WHERE role_uuid = ?", roleUuid)
+	if err != nil {
+		return err
+	}
+	_, err = server.Db.Exec("DELETE FROM channel_overrides WHERE target_uuid = ?", roleUuid)
+	if err != nil {
+		return err
+	}
+	_, err = server.Db.Model(role).WherePK().Delete()
+	if err != nil {
+		return err
+	}
+
+	roles := []*Role{}
+	for _, r := range p.roles {
+		if r.Uuid != roleUuid {
+			roles = append(roles, r)
+		}
+	}
+	p.roles = roles
+	for userUuid, roleUuids := range p.userRoles {
+		p.userRoles[userUuid] = removeString(roleUuids, roleUuid)
+	}
+	for channelUuid, overrides := range p.overrides {
+		kept := []*ChannelOverride{}
+		for _, override := range overrides {
+			if override.TargetUuid != roleUuid {
+				kept = append(kept, override)
+			}
+		}
+		p.overrides[channelUuid] = kept
+	}
+	server.broadcastRoles()
+
+	return nil
+}
+
+// SetUserRole assigns or removes a role, the member role can't be either.
+func (server *Server) SetUserRole(actorUuid string, userUuid string, roleUuid string, assign bool) error {
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	role := p.roleByUuid(roleUuid)
+	if role == nil || role.Key == ROLE_KEY_MEMBER {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown role %s", roleUuid)
+	}
+	err := p.canManage(actorUuid, role.Position, role.Permissions)
+	if err != nil {
+		return err
+	}
+	if actorUuid != userUuid && !p.isOwner(actorUuid) && p.highestPosition(userUuid) >= p.highestPosition(actorUuid) {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "user is above your highest role")
+	}
+
+	roleUuids := p.userRoles[userUuid]
+	if assign {
+		for _, r := range roleUuids {
+			if r == roleUuid {
+				return nil
+			}
+		}
+		_, err = server.Db.Model(&UserRole{userUuid, roleUuid}).Insert()
+		roleUuids = append(roleUuids, roleUuid)
+	} else {
+		_, err = server.Db.Model(&UserRole{userUuid, roleUuid}).WherePK().Delete()
+		roleUuids = removeString(roleUuids, roleUuid)
+	}
+	if err != nil {
+		return err
+	}
+	p.userRoles[userUuid] = roleUuids
+
+	user := &User{
+		Uuid: userUuid,
+	}
+	err = server.Db.Model(user).WherePK().ExcludeColumn("password").Select()
+	if err != nil {
+		return err
+	}
+	user.RoleUuids = append([]string{}, roleUuids...)
+
+	go func() {
+		server.Hub.UsersUpdate <- UsersPacket{
+			PACKET_TYPE_UPDATE_USERS,
+			[]User{*user},
+		}
+	}()
+
+	return nil
+}
+
+// SetChannelOverride replaces the override of the target in the channel, an
+// override allowing and denying nothing is removed.
+func (server *Server) SetChannelOverride(actorUuid string, override ChannelOverride) error {
+	channel := server.GetChannelByUuid(override.ChannelUuid)
+	if channel == nil {
+		return NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", override.ChannelUuid)
+	}
+	// Direct messages only follow their participants, and aren't announced
+	// to everyone.
+	if channel.IsDirect() {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "direct messages have no overrides")
+	}
+	if (override.Allow|override.Deny)&^PERMISSION_ALL != 0 || (override.Allow|override.Deny)&PERMISSION_ADMINISTRATOR != 0 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "invalid permissions")
+	}
+
+	p := &server.Permissions
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	err := p.canOverride(actorUuid, channel, override)
+	if err != nil {
+		return err
+	}
+
+	if override.Allow == 0 && override.Deny == 0 {
+		_, err = server.Db.Model(&override).WherePK().Delete()
+	} else {
+		_, err = server.Db.Model(&override).OnConflict("(channel_uuid, target_uuid) DO UPDATE").Set("allow = EXCLUDED.allow, deny = EXCLUDED.deny").Insert()
+	}
+	if err != nil {
+		return err
+	}
+
+	overrides := []*ChannelOverride{}
+	for _, o := range p.overrides[override.ChannelUuid] {
+		if o.TargetUuid != override.TargetUuid {
+			overrides = append(overrides, o)
+		}
+	}
+	if override.Allow != 0 || override.Deny != 0 {
+		overrides = append(overrides, &override)
+	}
+	p.overrides[override.ChannelUuid] = overrides
+
+	// Clients which gained or lost the channel add or remove it.
+	go func() {
+		server.Hub.ChannelsUpdate <- ChannelsPacket{
+			PACKET_TYPE_UPDATE_CHANNELS,
+			[]Channel{*channel},
+		}
+	}()
+
+	return nil
+}
+
+func (server *Server) GetChannelOverrides(channelUuid string) []ChannelOverride {
+	server.Permissions.mux.RLock()
+	defer server.Permissions.mux.RUnlock()
+	overrides := []ChannelOverride{}
+	for _, override := range server.Permissions.overrides[channelUuid] {
+		overrides = append(overrides, *override)
+	}
+	return overrides
+}
+
+// broadcastRoles must be called with the permissions lock held.
+func (server *Server) broadcastRoles() {
+	roles := make([]Role, 0, len(server.Permissions.roles))
+	for _, role := range server.Permissions.roles {
+		roles = append(roles, *role)
+	}
+	go func() {
+		server.Hub.Broadcast <- Packet{
+			Type: PACKET_TYPE_UPDATE_ROLES,
+			Data: roles,
+		}
+	}()
+}
+
+func (s *Server) HttpGetRoles(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	_, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	json, err := json.Marshal(s.GetRoles())
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPostRole(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	request, err := parseRoleForm(ctx)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	role, err := s.CreateRole(userUuid, request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(role)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPatchRole(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	roleUuid := ctx.UserValue("uuid")
+	if roleUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	request, err := parseRoleForm(ctx)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	role, err := s.UpdateRole(userUuid, roleUuid.(string), request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(role)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpDeleteRole(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	roleUuid := ctx.UserValue("uuid")
+	if roleUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.DeleteRole(userUuid, roleUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+func (s *Server) HttpPutUserRole(ctx *fasthttp.RequestCtx) {
+	s.httpSetUserRole(ctx, true)
+}
+
+func (s *Server) HttpDeleteUserRole(ctx *fasthttp.RequestCtx) {
+	s.httpSetUserRole(ctx, false)
+}
+
+func (s *Server) httpSetUserRole(ctx *fasthttp.RequestCtx, assign bool) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	actorUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	userUuid := ctx.UserValue("uuid")
+	roleUuid := ctx.UserValue("roleUuid")
+	if userUuid == nil || roleUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.SetUserRole(actorUuid, userUuid.(string), roleUuid.(string), assign)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusNotFound)
+		} else {
+			HttpError(ctx, err)
+		}
+		return
+	}
+}
+
+func (s *Server) HttpGetChannelOverrides(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	if channelUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.Authorize(userUuid, channelUuid.(string), PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(s.GetChannelOverrides(channelUuid.(string)))
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpPutChannelOverride(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	targetUuid := ctx.UserValue("targetUuid")
+	if channelUuid == nil || targetUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	override := ChannelOverride{
+		ChannelUuid: channelUuid.(string),
+		TargetUuid:  targetUuid.(string),
+	}
+	for key, permission := range map[string]*Permission{"allow": &override.Allow, "deny": &override.Deny} {
+		value, err := strconv.ParseInt(string(ctx.FormValue(key)), 10, 64)
+		if err != nil && len(ctx.FormValue(key)) > 0 {
+			ctx.Error("", fasthttp.StatusBadRequest)
+			return
+		}
+		*permission = Permission(value)
+	}
+
+	err = s.SetChannelOverride(userUuid, override)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+func (s *Server) HttpDeleteChannelOverride(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	targetUuid := ctx.UserValue("targetUuid")
+	if channelUuid == nil || targetUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.SetChannelOverride(userUuid, ChannelOverride{
+		ChannelUuid: channelUuid.(string),
+		TargetUuid:  targetUuid.(string),
+	})
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+func parseRoleForm(ctx *fasthttp.RequestCtx) (RoleRequest, error) {
+	request := RoleRequest{
+		Name: HttpOptionalFormValue(ctx, "name"),
+	}
+	if value := HttpOptionalFormValue(ctx, "permissions"); value != nil {
+		permissions, err := strconv.ParseInt(*value, 10, 64)
+		if err != nil {
+			return request, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "permissions must be an integer")
+		}
+		p := Permission(permissions)
+		request.Permissions = &p
+	}
+	if value := HttpOptionalFormValue(ctx, "position"); value != nil {
+		position, err := strconv.Atoi(*value)
+		if err != nil {
+			return request, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "position must be an integer")
+		}
+		request.Position = &position
+	}
+	return request, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestCanManage(t *testing.T) {
+	p := newTestPermissions(map[string][]string{
+		"owner":   {ROLE_KEY_OWNER},
+		"admin":   {ROLE_KEY_ADMIN},
+		"mod":     {ROLE_KEY_MODERATOR},
+		"manager": {"manager"},
+	})
+
+	cases := []struct {
+		name        string
+		actorUuid   string
+		position    int
+		permissions Permission
+		ok          bool
+	}{
+		{"owner above everyone", "owner", 2000, PERMISSION_ALL, true},
+		{"without MANAGE_ROLES", "mod", 1, PERMISSION_VIEW_CHANNEL, false},
+		{"below and within permissions", "manager", 50, PERMISSION_VIEW_CHANNEL | PERMISSION_MANAGE_ROLES, true},
+		{"at the actor position", "manager", 100, PERMISSION_VIEW_CHANNEL, false},
+		{"above the actor position", "manager", 500, 0, false},
+		{"permissions the actor lacks", "manager", 50, PERMISSION_MANAGE_MESSAGES, false},
+		{"administrator grants anything below", "admin", 899, PERMISSION_ALL, true},
+		{"administrator at its position", "admin", 900, 0, false},
+	}
+	for _, c := range cases {
+		err := p.canManage(c.actorUuid, c.position, c.permissions)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestCanOverride(t *testing.T) {
+	p := newTestPermissions(map[string][]string{
+		"owner": {ROLE_KEY_OWNER},
+		"admin": {ROLE_KEY_ADMIN},
+		"mod":   {ROLE_KEY_MODERATOR},
+		"alice": {"manager"},
+		"peer":  {"manager"},
+	})
+	public := &Channel{Uuid: "public", Type: CHANNEL_TYPE_TEXT}
+	locked := &Channel{Uuid: "locked", Type: CHANNEL_TYPE_TEXT}
+	p.overrides["locked"] = []*ChannelOverride{
+		{ChannelUuid: "locked", TargetUuid: "manager", Deny: PERMISSION_MANAGE_CHANNELS},
+	}
+
+	cases := []struct {
+		name      string
+		actorUuid string
+		channel   *Channel
+		override  ChannelOverride
+		ok        bool
+	}{
+		{"member role", "alice", public, ChannelOverride{TargetUuid: ROLE_KEY_MEMBER, Deny: PERMISSION_SEND_MESSAGES}, true},
+		{"user below", "alice", public, ChannelOverride{TargetUuid: "user", Allow: PERMISSION_VIEW_CHANNEL}, true},
+		{"without MANAGE_ROLES", "mod", public, ChannelOverride{TargetUuid: "user", Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"without MANAGE_CHANNELS in the channel", "alice", locked, ChannelOverride{TargetUuid: "user", Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"granting permissions the actor lacks", "alice", public, ChannelOverride{TargetUuid: ROLE_KEY_MEMBER, Allow: PERMISSION_MANAGE_MESSAGES}, false},
+		{"denying permissions the actor lacks", "alice", public, ChannelOverride{TargetUuid: ROLE_KEY_MEMBER, Deny: PERMISSION_KICK_MEMBERS}, false},
+		{"the actor itself", "alice", public, ChannelOverride{TargetUuid: "alice", Allow: PERMISSION_VIEW_CHANNEL}, false},
+		{"the role of the actor", "alice", public, ChannelOverride{TargetUuid: "manager", Allow: PERMISSION_VIEW_CHANNEL}, false},
+		{"a user of the same rank", "alice", public, ChannelOverride{TargetUuid: "peer", Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"a role above", "alice", public, ChannelOverride{TargetUuid: ROLE_KEY_MODERATOR, Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"a user above", "alice", public, ChannelOverride{TargetUuid: "mod", Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"administrator below", "admin", public, ChannelOverride{TargetUuid: ROLE_KEY_MODERATOR, Allow: PERMISSION_MENTION_EVERYONE}, true},
+		{"administrator on an owner", "admin", public, ChannelOverride{TargetUuid: "owner", Deny: PERMISSION_SEND_MESSAGES}, false},
+		{"owner on itself", "owner", public, ChannelOverride{TargetUuid: "owner", Deny: PERMISSION_SEND_MESSAGES}, true},
+	}
+	for _, c := range cases {
+		c.override.ChannelUuid = c.channel.Uuid
+		err := p.canOverride(c.actorUuid, c.channel, c.override)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
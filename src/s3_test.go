@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var s3AuthorizationRegexp = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+// fakeS3 is a minimal S3 compatible server for a single bucket addressed in
+// path style, it checks the signature of every request.
+type fakeS3 struct {
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	mux       sync.Mutex
+	objects   map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		bucket:    "chattin",
+		region:    "eu-west-3",
+		accessKey: "access",
+		secretKey: "secret",
+		objects:   make(map[string][]byte),
+	}
+}
+
+func (f *fakeS3) storage(t *testing.T, endpoint string, secretKey string) *S3Storage {
+	storage, err := NewS3Storage(S3Configuration{
+		Endpoint:  endpoint,
+		Bucket:    f.bucket,
+		Region:    f.region,
+		AccessKey: f.accessKey,
+		SecretKey: secretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func fakeHmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// verify recomputes the signature version 4 of the request from what was
+// received.
+func (f *fakeS3) verify(r *http.Request) error {
+	match := s3AuthorizationRegexp.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return fmt.Errorf("malformed authorization %q", r.Header.Get("Authorization"))
+	}
+	accessKey, day, region, signedHeaders, signature := match[1], match[2], match[3], match[4], match[5]
+	if accessKey != f.accessKey || region != f.region {
+		return fmt.Errorf("unexpected credential %s/%s", accessKey, region)
+	}
+	date := r.Header.Get("x-amz-date")
+	if !strings.HasPrefix(date, day) {
+		return fmt.Errorf("x-amz-date %s doesn't match the credential day %s", date, day)
+	}
+	if _, err := time.Parse("20060102T150405Z", date); err != nil {
+		return err
+	}
+
+	canonicalHeaders := ""
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	if !strings.Contains(signedHeaders, "host") || !strings.Contains(signedHeaders, "x-amz-date") {
+		return fmt.Errorf("host and x-amz-date must be signed, got %s", signedHeaders)
+	}
+	payload := r.Header.Get("x-amz-content-sha256")
+	if len(payload) == 0 {
+		return fmt.Errorf("missing x-amz-content-sha256")
+	}
+
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" + signedHeaders + "\n" + payload
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := fakeHmac([]byte("AWS4"+f.secretKey), day)
+	key = fakeHmac(key, region)
+	key = fakeHmac(key, "s3")
+	key = fakeHmac(key, "aws4_request")
+	if expected := hex.EncodeToString(fakeHmac(key, stringToSign)); signature != expected {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := f.verify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		rangeHeader := r.Header.Get("Range")
+		if len(rangeHeader) == 0 {
+			w.Write(object)
+			return
+		}
+		bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start >= len(object) {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		end := len(object) - 1
+		if len(bounds[1]) > 0 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if end >= len(object) {
+				end = len(object) - 1
+			}
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(object[start : end+1])
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	testStorage(t, fake.storage(t, server.URL, fake.secretKey))
+}
+
+func TestS3StorageEscapedKey(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	storage := fake.storage(t, server.URL, fake.secretKey)
+
+	key := "uploads/a b+c=é/0"
+	err := storage.Put(key, strings.NewReader("chunk"), 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects[key]; !ok {
+		t.Fatalf("object stored under the wrong key, have %v", fake.objects)
+	}
+	blob, err := storage.Get(key, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, _ := ioutil.ReadAll(blob)
+	if string(content) != "chunk" {
+		t.Errorf("got %q", content)
+	}
+}
+
+func TestS3StorageWrongSecret(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	storage := fake.storage(t, server.URL, "wrong")
+
+	err := storage.Put("files/blob", strings.NewReader("abc"), 3, "")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("put with a wrong secret: got %v, want a 403 error", err)
+	}
+	_, err = storage.Get("files/blob", 0, -1)
+	if err == nil || err == ErrBlobNotFound {
+		t.Errorf("get with a wrong secret: got %v, want a 403 error", err)
+	}
+}
+
+func TestS3ObjectUrl(t *testing.T) {
+	storage, err := NewS3Storage(S3Configuration{
+		Endpoint: "https://s3.example.com",
+		Bucket:   "chattin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storage.objectUrl("files/a b").String(), "https://chattin.s3.example.com/files/a%20b"; got != want {
+		t.Errorf("virtual hosted url = %s, want %s", got, want)
+	}
+
+	storage.config.PathStyle = true
+	if got, want := storage.objectUrl("files/a+b").String(), "https://s3.example.com/chattin/files/a%2Bb"; got != want {
+		t.Errorf("path style url = %s, want %s", got, want)
+	}
+}
+
+func TestS3SignatureHeaders(t *testing.T) {
+	storage, err := NewS3Storage(S3Configuration{
+		Endpoint:  "http://localhost:9000",
+		Bucket:    "chattin",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, storage.objectUrl("files/blob").String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.sign(req, time.Date(2021, 7, 1, 12, 30, 0, 0, time.UTC))
+
+	if got := req.Header.Get("x-amz-date"); got != "20210701T123000Z" {
+		t.Errorf("x-amz-date = %s", got)
+	}
+	if got := req.Header.Get("x-amz-content-sha256"); got != "UNSIGNED-PAYLOAD" {
+		t.Errorf("x-amz-content-sha256 = %s", got)
+	}
+	match := s3AuthorizationRegexp.FindStringSubmatch(req.Header.Get("Authorization"))
+	if match == nil {
+		t.Fatalf("malformed authorization %q", req.Header.Get("Authorization"))
+	}
+	if match[1] != "access" || match[2] != "20210701" || match[3] != "us-east-1" || match[4] != "host;x-amz-content-sha256;x-amz-date" {
+		t.Errorf("unexpected authorization %q", req.Header.Get("Authorization"))
+	}
+}
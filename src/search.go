@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	SEARCH_DEFAULT_COUNT = 25
+	SEARCH_MAX_COUNT     = 100
+	SEARCH_MAX_LENGTH    = 256
+)
+
+// SearchResult is a message matching a search, Highlight is an excerpt of
+// its content, HTML escaped, with the matching words in <mark> tags.
+type SearchResult struct {
+	tableName struct{} `pg:",discard_unknown_columns"`
+	Message
+	Highlight string `json:"highlight"`
+}
+
+type SearchResults struct {
+	Messages []SearchResult `json:"messages"`
+	// Cursor fetches the next page, it is empty on the last one.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type SearchRequest struct {
+	Query       string
+	ChannelUuid string
+	AuthorUuid  string
+	MentionUuid string
+	After       time.Time
+	Before      time.Time
+	HasFile     *bool
+	Cursor      string
+	Count       int
+}
+
+func (r *SearchRequest) Validate() error {
+	r.Query = strings.TrimSpace(r.Query)
+	if len(r.Query) == 0 {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "q is required")
+	}
+	if len(r.Query) > SEARCH_MAX_LENGTH {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "q can't be longer than %d characters", SEARCH_MAX_LENGTH)
+	}
+	for field, value := range map[string]string{"channel": r.ChannelUuid, "author": r.AuthorUuid, "mentions": r.MentionUuid} {
+		if len(value) > 0 {
+			err := validateUuid(field, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if r.Count <= 0 || r.Count > SEARCH_MAX_COUNT {
+		return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be between 1 and %d", SEARCH_MAX_COUNT)
+	}
+	return nil
+}
+
+// GetReadableChannelUuids returns the uuids of the server channels and
+// direct messages the user can read.
+func (server *Server) GetReadableChannelUuids(userUuid string) []string {
+	channelUuids := []string{}
+	for _, channel := range server.GetVisibleChannels(userUuid) {
+		channelUuids = append(channelUuids, channel.Uuid)
+	}
+	for _, channel := range server.GetDirectChannels(userUuid) {
+		channelUuids = append(channelUuids, channel.Uuid)
+	}
+	return channelUuids
+}
+
+// SearchMessages runs a full-text search restricted to the channels the user
+// can read.
+func (server *Server) SearchMessages(userUuid string, request SearchRequest) (*SearchResults, error) {
+	err := request.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	channelUuids := server.GetReadableChannelUuids(userUuid)
+	if len(request.ChannelUuid) > 0 {
+		if server.GetChannelByUuid(request.ChannelUuid) == nil {
+			return nil, NewPacketError(ERROR_CODE_UNKNOWN_CHANNEL, "unknown channel %s", request.ChannelUuid)
+		}
+		err = server.Authorize(userUuid, request.ChannelUuid, PERMISSION_VIEW_CHANNEL)
+		if err != nil {
+			return nil, err
+		}
+		channelUuids = []string{request.ChannelUuid}
+	}
+
+	results := &SearchResults{
+		Messages: []SearchResult{},
+	}
+	if len(channelUuids) == 0 {
+		return results, nil
+	}
+
+	params := []interface{}{}
+	param := func(value interface{}) string {
+		params = append(params, value)
+		return "?" + strconv.Itoa(len(params)-1)
+	}
+
+	tsquery := "websearch_to_tsquery('simple', " + param(request.Query) + ")"
+	conditions := []string{
+		"search @@ " + tsquery,
+		"channel_uuid IN (" + param(pg.In(channelUuids)) + ")",
+		"deleted IS NULL",
+	}
+	if len(request.AuthorUuid) > 0 {
+		conditions = append(conditions, "user_uuid = "+param(request.AuthorUuid))
+	}
+	if len(request.MentionUuid) > 0 {
+		conditions = append(conditions, "uuid IN (SELECT message_uuid FROM mentions WHERE user_uuid = "+param(request.MentionUuid)+")")
+	}
+	if !request.After.IsZero() {
+		conditions = append(conditions, "date >= "+param(request.After))
+	}
+	if !request.Before.IsZero() {
+		conditions = append(conditions, "date < "+param(request.Before))
+	}
+	if request.HasFile != nil {
+		if *request.HasFile {
+			conditions = append(conditions, "coalesce(jsonb_array_length(files), 0) > 0")
+		} else {
+			conditions = append(conditions, "coalesce(jsonb_array_length(files), 0) = 0")
+		}
+	}
+	if len(request.Cursor) > 0 {
+		cursor, err := decodeMessageCursor(request.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "(date, uuid) < ("+param(cursor.date)+", "+param(cursor.uuid)+")")
+	}
+
+	// One more result than requested tells whether there is a next page.
+	query := `SELECT *, ts_headline('simple', replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+			` + tsquery + `, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2') AS highlight
+		FROM messages
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY date DESC, uuid DESC
+		LIMIT ` + param(request.Count+1)
+
+	_, err = server.Db.Query(&results.Messages, query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results.Messages) > request.Count {
+		results.Messages = results.Messages[:request.Count]
+		results.Cursor = encodeMessageCursor(&results.Messages[request.Count-1].Message)
+	}
+
+	return results, nil
+}
+
+func (s *Server) HttpSearch(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	request := SearchRequest{
+		Query:       string(ctx.FormValue("q")),
+		ChannelUuid: string(ctx.FormValue("channel")),
+		AuthorUuid:  string(ctx.FormValue("author")),
+		MentionUuid: string(ctx.FormValue("mentions")),
+		Cursor:      string(ctx.FormValue("cursor")),
+		Count:       SEARCH_DEFAULT_COUNT,
+	}
+	for key, date := range map[string]*time.Time{"after": &request.After, "before": &request.Before} {
+		if value := HttpOptionalFormValue(ctx, key); value != nil {
+			*date, err = time.Parse(time.RFC3339, *value)
+			if err != nil {
+				HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "%s must be an RFC 3339 date", key))
+				return
+			}
+		}
+	}
+	request.HasFile, err = HttpOptionalFormBool(ctx, "hasFile")
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+	if value := HttpOptionalFormValue(ctx, "count"); value != nil {
+		request.Count, err = strconv.Atoi(*value)
+		if err != nil {
+			HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "count must be an integer"))
+			return
+		}
+	}
+
+	results, err := s.SearchMessages(userUuid, request)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	json, err := json.Marshal(results)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/fasthttp/router"
 	"github.com/go-pg/pg/v10"
@@ -9,11 +11,42 @@ import (
 )
 
 type Server struct {
-	Db            *pg.DB
-	Router        *router.Router
-	Hub           *Hub
-	Channels      []*Channel
-	Configuration Configuration
+	Db             *pg.DB
+	Router         *router.Router
+	Hub            *Hub
+	Channels       []*Channel
+	DirectChannels map[string]*Channel
+	ChannelsMux    sync.RWMutex
+	Configuration  Configuration
+	PasswordHasher PasswordHasher
+	TokenLifetime  time.Duration
+	// DeletedMessageRetention is how long deleted messages can be restored
+	// before they are purged.
+	DeletedMessageRetention time.Duration
+	// MaxFileSize is the largest file that can be uploaded, files bigger
+	// than MaxBodySize must be sent in chunks to /uploads.
+	MaxFileSize int64
+	MaxBodySize int64
+	// FileUrlSecret signs the file urls that work without a token for
+	// FileUrlLifetime.
+	FileUrlSecret   []byte
+	FileUrlLifetime time.Duration
+	MessageNonces   *NonceCache
+	Storage         Storage
+	Permissions     Permissions
+	OwnerLogin      string
+	MetricsToken    string
+	WebSocket       WebSocketConfiguration
+}
+
+type WebSocketConfiguration struct {
+	PingInterval   time.Duration
+	PongWait       time.Duration
+	WriteWait      time.Duration
+	MaxMessageSize int64
+	SendQueueSize  int
+	EventLogSize   int
+	OverflowPolicy OverflowPolicy
 }
 
 type Configuration struct {
@@ -22,13 +55,40 @@ type Configuration struct {
 	Description string   `json:"description"`
 }
 
+// GetChannelByUuid returns the channel or nil if it doesn't exist. Channels
+// are replaced rather than modified so the returned value is safe to read.
 func (server *Server) GetChannelByUuid(uuid string) *Channel {
+	server.ChannelsMux.RLock()
+	defer server.ChannelsMux.RUnlock()
 	for _, channel := range server.Channels {
 		if channel.Uuid == uuid {
 			return channel
 		}
 	}
-	return nil
+	return server.DirectChannels[uuid]
+}
+
+// GetChannels returns the server channels, direct message channels are
+// listed separately by GetDirectChannels.
+func (server *Server) GetChannels() []Channel {
+	server.ChannelsMux.RLock()
+	defer server.ChannelsMux.RUnlock()
+	channels := make([]Channel, 0, len(server.Channels))
+	for _, channel := range server.Channels {
+		channels = append(channels, *channel)
+	}
+	return channels
+}
+
+// GetVisibleChannels returns the channels the user is allowed to view.
+func (server *Server) GetVisibleChannels(userUuid string) []Channel {
+	channels := []Channel{}
+	for _, channel := range server.GetChannels() {
+		if server.Authorize(userUuid, channel.Uuid, PERMISSION_VIEW_CHANNEL) == nil {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
 }
 
 func (s *Server) HttpGetConfiguration(ctx *fasthttp.RequestCtx) {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// SESSION_RESUME_TTL is how long the session of a disconnected client can
+	// be resumed.
+	SESSION_RESUME_TTL = 5 * time.Minute
+)
+
+// PacketAuthRequest authenticates a connection. A client that reconnects
+// gives the session it had and the seq of the last event it received to
+// get the events it missed.
+type PacketAuthRequest struct {
+	Token     string `json:"token"`
+	SessionId string `json:"sessionId"`
+	Seq       uint64 `json:"seq"`
+}
+
+func (p *PacketAuthRequest) Validate() error {
+	if len(p.SessionId) > 0 {
+		return validateUuid("sessionId", p.SessionId)
+	}
+	return nil
+}
+
+// PacketResync tells a client that its missed events can't be replayed, it
+// must fetch its state again. The connection goes on with a new session.
+type PacketResync struct {
+	SessionId string `json:"sessionId"`
+	Seq       uint64 `json:"seq"`
+}
+
+// Session is what is kept of a disconnected client to resume it.
+type Session struct {
+	userUuid     string
+	channelUuids []string
+	threadUuids  []string
+	expires      time.Time
+}
+
+// eventAudience tells which clients received a logged event, so that it can
+// be replayed to a resuming client which would have received it.
+type eventAudience struct {
+	all         bool
+	channelUuid string
+	threadUuid  string
+	userUuids   []string
+	channels    *ChannelsPacket
+	users       *UsersPacket
+}
+
+type loggedEvent struct {
+	audience eventAudience
+	packet   Packet
+}
+
+// EventLog keeps the last events sent by the hub, it is only accessed by the
+// hub goroutine.
+type EventLog struct {
+	events []loggedEvent
+	next   int
+	seq    uint64
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{
+		events: make([]loggedEvent, 0, size),
+	}
+}
+
+// Append stamps the packet with the next seq and logs it, the oldest event
+// is forgotten once the log is full.
+func (eventLog *EventLog) Append(audience eventAudience, packet Packet) Packet {
+	eventLog.seq++
+	packet.Seq = eventLog.seq
+
+	event := loggedEvent{audience, packet}
+	if len(eventLog.events) < cap(eventLog.events) {
+		eventLog.events = append(eventLog.events, event)
+	} else if len(eventLog.events) > 0 {
+		eventLog.events[eventLog.next] = event
+		eventLog.next = (eventLog.next + 1) % len(eventLog.events)
+	}
+	return packet
+}
+
+// Since returns the events after seq in order, ok is false when some of them
+// were already forgotten.
+func (eventLog *EventLog) Since(seq uint64) (events []loggedEvent, ok bool) {
+	if seq > eventLog.seq {
+		return nil, false
+	}
+	missed := eventLog.seq - seq
+	if missed > uint64(len(eventLog.events)) {
+		return nil, false
+	}
+	for i := len(eventLog.events) - int(missed); i < len(eventLog.events); i++ {
+		events = append(events, eventLog.events[(eventLog.next+i)%len(eventLog.events)])
+	}
+	return events, true
+}
+
+// record logs an event before it is sent, typing and presence packets are
+// short lived and aren't replayed.
+func (hub *Hub) record(audience eventAudience, packet Packet) Packet {
+	if packet.Type == PACKET_TYPE_TYPING || packet.Type == PACKET_TYPE_PRESENCE {
+		return packet
+	}
+	return hub.Events.Append(audience, packet)
+}
+
+// saveSession keeps the subscriptions of a client which disconnected, it
+// must be called before the client is unsubscribed.
+func (hub *Hub) saveSession(client *Client) {
+	session := &Session{
+		userUuid: client.User.Uuid,
+		expires:  time.Now().Add(SESSION_RESUME_TTL),
+	}
+	for channelUuid, subscribers := range hub.Channels {
+		if subscribers[client] {
+			session.channelUuids = append(session.channelUuids, channelUuid)
+		}
+	}
+	for threadUuid, subscribers := range hub.Threads {
+		if subscribers[client] {
+			session.threadUuids = append(session.threadUuids, threadUuid)
+		}
+	}
+	hub.Sessions[client.SessionId] = session
+}
+
+func (hub *Hub) expireSessions(now time.Time) {
+	for sessionId, session := range hub.Sessions {
+		if now.After(session.expires) {
+			delete(hub.Sessions, sessionId)
+		}
+	}
+}
+
+// resume restores the subscriptions of the session of a reconnecting client
+// and replays the events it missed. A resync is requested instead when the
+// session is gone or the events don't fit in the send queue.
+func (hub *Hub) resume(client *Client, seq uint64) {
+	session, ok := hub.Sessions[client.SessionId]
+	if ok && session.userUuid == client.User.Uuid {
+		delete(hub.Sessions, client.SessionId)
+
+		channels := make(map[string]bool)
+		for _, channelUuid := range session.channelUuids {
+			channels[channelUuid] = true
+		}
+		threads := make(map[string]bool)
+		for _, threadUuid := range session.threadUuids {
+			threads[threadUuid] = true
+		}
+
+		events, ok := hub.Events.Since(seq)
+		var packets []Packet
+		for _, event := range events {
+			packets = append(packets, hub.replayPackets(client, channels, threads, event)...)
+		}
+		if ok && len(packets) < hub.Server.WebSocket.SendQueueSize/2 {
+			for channelUuid := range channels {
+				hub.subscribe(client, channelUuid)
+			}
+			for threadUuid := range threads {
+				hub.subscribeThread(client, threadUuid)
+			}
+			for _, packet := range packets {
+				client.SendPacket(packet)
+			}
+			return
+		}
+	}
+
+	client.SessionId = uuid.New().String()
+	client.SendPacket(Packet{
+		Type: PACKET_TYPE_RESYNC,
+		Data: PacketResync{
+			client.SessionId,
+			hub.Events.seq,
+		},
+	})
+}
+
+// replayPackets returns the packets the client would have received for the
+// event had it been connected, as far as it is still allowed to see them.
+func (hub *Hub) replayPackets(client *Client, channels map[string]bool, threads map[string]bool, event loggedEvent) []Packet {
+	audience := event.audience
+	userUuid := client.User.Uuid
+	switch {
+	case audience.all:
+		return []Packet{event.packet}
+	case audience.channels != nil:
+		packets := channelsPackets(hub.Server, userUuid, audience.channels.packetType, audience.channels.channels)
+		for i := range packets {
+			packets[i].Seq = event.packet.Seq
+		}
+		return packets
+	case audience.users != nil:
+		packet := hub.usersPacket(userUuid, *audience.users)
+		packet.Seq = event.packet.Seq
+		return []Packet{packet}
+	case len(audience.threadUuid) > 0:
+		channel := hub.Server.GetChannelByUuid(audience.channelUuid)
+		if channel == nil || !hub.Server.CanView(userUuid, channel) {
+			return nil
+		}
+		if threads[audience.threadUuid] || containsString(audience.userUuids, userUuid) {
+			return []Packet{event.packet}
+		}
+	case len(audience.channelUuid) > 0:
+		channel := hub.Server.GetChannelByUuid(audience.channelUuid)
+		if channel == nil || !hub.Server.CanView(userUuid, channel) {
+			return nil
+		}
+		if channel.IsDirect() || channels[audience.channelUuid] {
+			return []Packet{event.packet}
+		}
+	case containsString(audience.userUuids, userUuid):
+		return []Packet{event.packet}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+	"gopkg.in/ini.v1"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Storage keeps the content of uploaded files and avatars, their metadata
+// stays in postgres. Keys are made of the table name and the uuid of the row.
+type Storage interface {
+	// Put stores size bytes read from r under the key.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens length bytes of the blob stored under the key from offset,
+	// or up to its end when length is negative. It fails with
+	// ErrBlobNotFound when there is no such blob.
+	Get(key string, offset int64, length int64) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+func blobKey(table string, uuid string) string {
+	return table + "/" + uuid
+}
+
+// NewStorage returns the storage backend chosen in the configuration, blobs
+// are stored on the local filesystem by default.
+func NewStorage(cfg *ini.File) (Storage, error) {
+	backend := getConfig(cfg, "STORAGE_BACKEND", "storage", "backend")
+	switch backend {
+	case "", "local":
+		path := getConfig(cfg, "STORAGE_PATH", "storage", "path")
+		if len(path) == 0 {
+			path = "files"
+		}
+		return NewLocalStorage(path)
+	case "s3":
+		return NewS3Storage(S3Configuration{
+			Endpoint:  getConfig(cfg, "S3_ENDPOINT", "storage", "s3_endpoint"),
+			Bucket:    getConfig(cfg, "S3_BUCKET", "storage", "s3_bucket"),
+			Region:    getConfig(cfg, "S3_REGION", "storage", "s3_region"),
+			AccessKey: getConfig(cfg, "S3_ACCESS_KEY", "storage", "s3_access_key"),
+			SecretKey: getConfig(cfg, "S3_SECRET_KEY", "storage", "s3_secret_key"),
+			PathStyle: getConfig(cfg, "S3_PATH_STYLE", "storage", "s3_path_style") != "false",
+		})
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// LocalStorage stores blobs as files under a directory.
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{root}, nil
+}
+
+func (storage *LocalStorage) path(key string) string {
+	return filepath.Join(storage.root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first so that a failed upload never leaves
+// a partial blob behind.
+func (storage *LocalStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	path := storage.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	written, err := io.Copy(temp, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("wrote %d bytes out of %d", written, size)
+	}
+	if err != nil {
+		temp.Close()
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func (storage *LocalStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(storage.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	if offset > 0 {
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return limitedReadCloser{io.LimitReader(file, length), file}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (storage *LocalStorage) Delete(key string) error {
+	err := os.Remove(storage.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// PutBlob stores the content of a file or an avatar and returns its
+// sha256, which identifies the content in ETags.
+func (server *Server) PutBlob(table string, uuid string, r io.Reader, size int64, contentType string) (string, error) {
+	hash := sha256.New()
+	err := server.Storage.Put(blobKey(table, uuid), io.TeeReader(r, hash), size, contentType)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// OpenBlob opens a part of the content of a file or an avatar, see
+// Storage.Get. Blobs uploaded before storage backends are read from the
+// database until they are migrated.
+func (server *Server) OpenBlob(table string, uuid string, offset int64, length int64) (io.ReadCloser, error) {
+	reader, err := server.Storage.Get(blobKey(table, uuid), offset, length)
+	if err != ErrBlobNotFound {
+		return reader, err
+	}
+
+	var data []byte
+	_, err = server.Db.QueryOne(pg.Scan(&data), "SELECT data FROM ? WHERE uuid = ? AND data IS NOT NULL", pg.Ident(table), uuid)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// MigrateBlobs moves the blobs still stored in the database to the storage
+// backend, one at a time so that it can be interrupted and run again. Blobs
+// stored without a hash are hashed along the way, missing blobs get an empty
+// hash so that they are only reported once.
+func (server *Server) MigrateBlobs() error {
+	for _, table := range []string{"files", "avatars"} {
+		migrated := 0
+		for {
+			var blob struct {
+				Uuid string
+				Type string
+				Data []byte
+			}
+			_, err := server.Db.QueryOne(&blob, "SELECT uuid, type, data FROM ? WHERE data IS NOT NULL LIMIT 1", pg.Ident(table))
+			if err == pg.ErrNoRows {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			hash, err := server.PutBlob(table, blob.Uuid, bytes.NewReader(blob.Data), int64(len(blob.Data)), blob.Type)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", strings.TrimSuffix(table, "s"), blob.Uuid, err)
+			}
+			_, err = server.Db.Exec("UPDATE ? SET data = NULL, size = ?, hash = ? WHERE uuid = ?", pg.Ident(table), len(blob.Data), hash, blob.Uuid)
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+		log.Printf("Moved %d %s out of the database", migrated, table)
+
+		hashed, missing := 0, 0
+		for {
+			var uuid string
+			_, err := server.Db.QueryOne(pg.Scan(&uuid), "SELECT uuid FROM ? WHERE hash IS NULL LIMIT 1", pg.Ident(table))
+			if err == pg.ErrNoRows {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			hash, size, err := server.hashBlob(table, uuid)
+			if err == ErrBlobNotFound {
+				log.Printf("Skipping %s %s, its content is missing", strings.TrimSuffix(table, "s"), uuid)
+				_, err = server.Db.Exec("UPDATE ? SET hash = '' WHERE uuid = ?", pg.Ident(table), uuid)
+				if err != nil {
+					return err
+				}
+				missing++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", strings.TrimSuffix(table, "s"), uuid, err)
+			}
+			_, err = server.Db.Exec("UPDATE ? SET size = ?, hash = ? WHERE uuid = ?", pg.Ident(table), size, hash, uuid)
+			if err != nil {
+				return err
+			}
+			hashed++
+		}
+		log.Printf("Hashed %d %s, %d missing", hashed, table, missing)
+	}
+	return nil
+}
+
+func (server *Server) hashBlob(table string, uuid string) (string, int64, error) {
+	blob, err := server.OpenBlob(table, uuid, 0, -1)
+	if err != nil {
+		return "", 0, err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, blob)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the checks every storage backend must pass.
+func testStorage(t *testing.T, storage Storage) {
+	content := "0123456789abcdef"
+	err := storage.Put("files/blob", strings.NewReader(content), int64(len(content)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := []struct {
+		offset int64
+		length int64
+		want   string
+	}{
+		{0, -1, content},
+		{0, int64(len(content)), content},
+		{4, -1, content[4:]},
+		{4, 3, content[4:7]},
+		{15, 1, content[15:]},
+		{3, 0, ""},
+	}
+	for _, r := range ranges {
+		blob, err := storage.Get("files/blob", r.offset, r.length)
+		if err != nil {
+			t.Fatalf("get %d+%d: %v", r.offset, r.length, err)
+		}
+		got, err := ioutil.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			t.Fatalf("read %d+%d: %v", r.offset, r.length, err)
+		}
+		if string(got) != r.want {
+			t.Errorf("get %d+%d = %q, want %q", r.offset, r.length, got, r.want)
+		}
+	}
+
+	err = storage.Delete("files/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Get("files/blob", 0, -1)
+	if err != ErrBlobNotFound {
+		t.Errorf("get after delete: got %v, want ErrBlobNotFound", err)
+	}
+	err = storage.Delete("files/blob")
+	if err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+	_, err = storage.Get("files/missing", 0, -1)
+	if err != ErrBlobNotFound {
+		t.Errorf("get missing: got %v, want ErrBlobNotFound", err)
+	}
+}
+
+// newLocalStorage returns a storage in a temporary directory removed at the
+// end of the test.
+func newLocalStorage(t *testing.T) *LocalStorage {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, newLocalStorage(t))
+}
+
+func TestLocalStorageShortPut(t *testing.T) {
+	storage := newLocalStorage(t)
+	err := storage.Put("files/short", bytes.NewReader([]byte("abc")), 10, "")
+	if err == nil {
+		t.Fatal("put with a short reader succeeded")
+	}
+	_, err = storage.Get("files/short", 0, -1)
+	if err != ErrBlobNotFound {
+		t.Errorf("a failed put left a blob behind: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(storage.root, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("a failed put left %d temporary file(s)", len(entries))
+	}
+}
+
+func TestPutBlobHash(t *testing.T) {
+	server := &Server{Storage: newLocalStorage(t)}
+	hash, err := server.PutBlob("files", "uuid", strings.NewReader("hello"), 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; hash != want {
+		t.Errorf("hash = %s, want %s", hash, want)
+	}
+}
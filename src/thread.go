@@ -0,0 +1,273 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/valyala/fasthttp"
+)
+
+// MessageQuote is the part of a message shown when it is replied to.
+type MessageQuote struct {
+	Uuid     string    `json:"uuid"`
+	UserUuid string    `json:"userUuid"`
+	Date     time.Time `json:"date"`
+	Content  string    `json:"content"`
+}
+
+type ThreadSubscription struct {
+	client     *Client
+	threadUuid string
+}
+
+// ThreadPacket is sent to the clients which opened the thread and to the
+// connections of the users who took part in it.
+type ThreadPacket struct {
+	channelUuid string
+	threadUuid  string
+	userUuids   []string
+	packet      Packet
+}
+
+type PacketThreadRequest struct {
+	ChannelUuid string `json:"channelUuid"`
+	ThreadUuid  string `json:"threadUuid"`
+}
+
+func (p *PacketThreadRequest) Validate() error {
+	err := validateUuid("channelUuid", p.ChannelUuid)
+	if err != nil {
+		return err
+	}
+	return validateUuid("threadUuid", p.ThreadUuid)
+}
+
+type PacketUpdateThread struct {
+	ChannelUuid     string    `json:"channelUuid"`
+	ThreadUuid      string    `json:"threadUuid"`
+	ThreadCount     int       `json:"threadCount"`
+	ThreadLastReply time.Time `json:"threadLastReply"`
+}
+
+func (hub *Hub) unsubscribeThread(client *Client, threadUuid string) {
+	subscribers, ok := hub.Threads[threadUuid]
+	if !ok {
+		return
+	}
+	delete(subscribers, client)
+	if len(subscribers) == 0 {
+		delete(hub.Threads, threadUuid)
+	}
+}
+
+func (hub *Hub) broadcastThread(threadPacket ThreadPacket) {
+	packet := hub.record(eventAudience{
+		channelUuid: threadPacket.channelUuid,
+		threadUuid:  threadPacket.threadUuid,
+		userUuids:   threadPacket.userUuids,
+	}, threadPacket.packet)
+	channel := hub.Server.GetChannelByUuid(threadPacket.channelUuid)
+	if channel == nil {
+		return
+	}
+
+	recipients := make(map[*Client]bool)
+	for c := range hub.Threads[threadPacket.threadUuid] {
+		recipients[c] = true
+	}
+	for _, userUuid := range threadPacket.userUuids {
+		if connections, ok := hub.Users[userUuid]; ok {
+			for c := range connections.clients {
+				recipients[c] = true
+			}
+		}
+	}
+
+	for c := range recipients {
+		if !hub.Server.CanView(c.User.Uuid, channel) {
+			hub.unsubscribeThread(c, threadPacket.threadUuid)
+			continue
+		}
+		c.SendPacket(packet)
+	}
+}
+
+// GetThreadRoot returns the message a thread hangs off, threads can't be
+// started from a reply in another thread.
+func (server *Server) GetThreadRoot(channelUuid string, threadUuid string) (*Message, error) {
+	return server.getThreadRoot(channelUuid, threadUuid, false)
+}
+
+// GetReadableThreadRoot is GetThreadRoot for reading the thread, whose
+// replies can still be read once the root was deleted on its own.
+func (server *Server) GetReadableThreadRoot(channelUuid string, threadUuid string) (*Message, error) {
+	return server.getThreadRoot(channelUuid, threadUuid, true)
+}
+
+func (server *Server) getThreadRoot(channelUuid string, threadUuid string, withDeleted bool) (*Message, error) {
+	root := &Message{
+		Uuid: threadUuid,
+	}
+	query := server.Db.Model(root).WherePK().Where("channel_uuid = ?", channelUuid)
+	if withDeleted {
+		query.AllWithDeleted()
+	}
+	err := query.Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", threadUuid)
+		}
+		return nil, err
+	}
+	if len(root.ThreadUuid) > 0 {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "threads can't be nested")
+	}
+	return root, nil
+}
+
+func (server *Server) GetMessageQuote(channelUuid string, messageUuid string) (*MessageQuote, error) {
+	quote := &MessageQuote{}
+	_, err := server.Db.QueryOne(quote, "SELECT uuid, user_uuid, date, content FROM messages WHERE uuid = ? AND channel_uuid = ? AND deleted IS NULL", messageUuid, channelUuid)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "message %s not found", messageUuid)
+		}
+		return nil, err
+	}
+	return quote, nil
+}
+
+// LoadReplyQuotes fills ReplyTo for the messages replying to a message which
+// still exists.
+func (server *Server) LoadReplyQuotes(messages []Message) error {
+	messageUuids := []string{}
+	for _, message := range messages {
+		if len(message.ReplyToUuid) > 0 {
+			messageUuids = append(messageUuids, message.ReplyToUuid)
+		}
+	}
+	if len(messageUuids) == 0 {
+		return nil
+	}
+
+	var quotes []MessageQuote
+	_, err := server.Db.Query(&quotes, "SELECT uuid, user_uuid, date, content FROM messages WHERE uuid IN (?) AND deleted IS NULL", pg.In(messageUuids))
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		for j := range quotes {
+			if quotes[j].Uuid == messages[i].ReplyToUuid {
+				messages[i].ReplyTo = &quotes[j]
+			}
+		}
+	}
+	return nil
+}
+
+// ThreadParticipants returns the author of the root message and of every
+// reply.
+func (server *Server) ThreadParticipants(threadUuid string) ([]string, error) {
+	var userUuids []string
+	_, err := server.Db.Query(&userUuids, "SELECT DISTINCT user_uuid FROM messages WHERE (uuid = ? OR thread_uuid = ?) AND deleted IS NULL", threadUuid, threadUuid)
+	return userUuids, err
+}
+
+// RefreshThread recounts the replies of the thread after one was posted or
+// deleted.
+func (server *Server) RefreshThread(channelUuid string, threadUuid string) (PacketUpdateThread, error) {
+	update := PacketUpdateThread{
+		ChannelUuid: channelUuid,
+		ThreadUuid:  threadUuid,
+	}
+	_, err := server.Db.QueryOne(&update, `UPDATE messages
+		SET thread_count = (SELECT count(*) FROM messages WHERE thread_uuid = ?0 AND deleted IS NULL),
+			thread_last_reply = (SELECT max(date) FROM messages WHERE thread_uuid = ?0 AND deleted IS NULL)
+		WHERE uuid = ?0
+		RETURNING thread_count, thread_last_reply`, threadUuid)
+	if err == pg.ErrNoRows {
+		err = nil
+	}
+	return update, err
+}
+
+// broadcastMessage sends a packet about the message to the channel, or to
+// the thread when the message is a reply in a thread.
+func (server *Server) broadcastMessage(message *Message, packet Packet) error {
+	if len(message.ThreadUuid) == 0 {
+		server.Hub.ChannelBroadcast <- ChannelPacket{
+			message.ChannelUuid,
+			packet,
+		}
+		return nil
+	}
+
+	participants, err := server.ThreadParticipants(message.ThreadUuid)
+	if err != nil {
+		return err
+	}
+	server.Hub.ThreadBroadcast <- ThreadPacket{
+		message.ChannelUuid,
+		message.ThreadUuid,
+		append(participants, message.UserUuid),
+		packet,
+	}
+	return nil
+}
+
+// refreshThread recounts the replies of the thread of the message and tells
+// the channel about it.
+func (server *Server) refreshThread(message *Message) error {
+	update, err := server.RefreshThread(message.ChannelUuid, message.ThreadUuid)
+	if err != nil {
+		return err
+	}
+	server.Hub.ChannelBroadcast <- ChannelPacket{
+		message.ChannelUuid,
+		Packet{
+			Type: PACKET_TYPE_UPDATE_THREAD,
+			Data: update,
+		},
+	}
+	return nil
+}
+
+func (s *Server) HttpGetThreadMessages(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	channelUuid := ctx.UserValue("uuid")
+	threadUuid := ctx.UserValue("messageUuid")
+	if channelUuid == nil || threadUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	if s.GetChannelByUuid(channelUuid.(string)) == nil {
+		ctx.Error("", fasthttp.StatusNotFound)
+		return
+	}
+	err = s.Authorize(userUuid, channelUuid.(string), PERMISSION_VIEW_CHANNEL)
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	_, err = s.GetReadableThreadRoot(channelUuid.(string), threadUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	s.httpMessagePage(ctx, userUuid, "thread_uuid = ?", threadUuid.(string))
+}
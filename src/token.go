@@ -1,16 +1,92 @@
 package main
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
 type Token struct {
-	Token    string `pg:",pk"`
-	UserUuid string `pg:",nopk"`
+	Token     string    `pg:",pk" json:"-"`
+	Uuid      string    `json:"uuid"`
+	UserUuid  string    `pg:",nopk" json:"-"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Expires   time.Time `json:"expires"`
+	UserAgent string    `json:"userAgent"`
+	Ip        string    `json:"ip"`
+	Current   bool      `pg:"-" json:"current"`
 }
 
-func (server *Server) GetUserUuidByToken(token string) (string, error) {
+// Tokens are only touched in the database when their last use is older than
+// this, so authenticated requests don't all turn into writes.
+const tokenLastUsedResolution = time.Minute
+
+func newTokenString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (server *Server) CreateToken(ctx *fasthttp.RequestCtx, userUuid string) (*Token, error) {
+	tokenString, err := newTokenString()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	token := &Token{
+		Token:     tokenString,
+		Uuid:      uuid.New().String(),
+		UserUuid:  userUuid,
+		Created:   now,
+		LastUsed:  now,
+		Expires:   now.Add(server.TokenLifetime),
+		UserAgent: string(ctx.UserAgent()),
+		Ip:        ctx.RemoteIP().String(),
+	}
+	_, err = server.Db.Model(token).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetToken returns the token if it exists and hasn't expired, pg.ErrNoRows
+// otherwise.
+func (server *Server) GetToken(token string) (*Token, error) {
 	userToken := &Token{
 		Token: token,
 	}
+	err := server.Db.Model(userToken).WherePK().Where("expires > now()").Select()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Sub(userToken.LastUsed) > tokenLastUsedResolution {
+		userToken.LastUsed = now
+		_, err = server.Db.Model(userToken).WherePK().Column("last_used").Update()
+		if err != nil {
+			log.Print(err)
+		}
+	}
 
-	err := server.Db.Model(userToken).WherePK().Select()
+	return userToken, nil
+}
+
+func (server *Server) GetUserUuidByToken(token string) (string, error) {
+	userToken, err := server.GetToken(token)
 	if err != nil {
 		return "", err
 	}
@@ -19,10 +95,7 @@ func (server *Server) GetUserUuidByToken(token string) (string, error) {
 }
 
 func (server *Server) GetUserByToken(token string) (*User, error) {
-	userToken := &Token{
-		Token: token,
-	}
-	err := server.Db.Model(userToken).WherePK().Select()
+	userToken, err := server.GetToken(token)
 	if err != nil {
 		return nil, err
 	}
@@ -39,12 +112,126 @@ func (server *Server) GetUserByToken(token string) (*User, error) {
 }
 
 func (server *Server) IsTokenValid(token string) (bool, error) {
-	userToken := &Token{
-		Token: token,
-	}
-	err := server.Db.Model(userToken).WherePK().Select()
+	_, err := server.GetToken(token)
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
+
+// RevokeToken deletes the token and disconnects every websocket
+// authenticated with it.
+func (server *Server) RevokeToken(token *Token) error {
+	_, err := server.Db.Model(token).WherePK().Delete()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		server.Hub.Revoke <- token.Token
+	}()
+
+	return nil
+}
+
+func (server *Server) PurgeExpiredTokens() {
+	for {
+		r, err := server.Db.Model((*Token)(nil)).Where("expires <= now()").Delete()
+		if err != nil {
+			log.Print(err)
+		} else if r.RowsAffected() > 0 {
+			log.Printf("Purged %d expired token(s)", r.RowsAffected())
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (s *Server) HttpUserLogout(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userToken, err := s.GetToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	err = s.RevokeToken(userToken)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+}
+
+func (s *Server) HttpGetSessions(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userToken, err := s.GetToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	var sessions []Token
+	err = s.Db.Model(&sessions).Where("user_uuid = ?", userToken.UserUuid).Where("expires > now()").Order("last_used DESC").Select()
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Token == userToken.Token
+	}
+
+	json, err := json.Marshal(sessions)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Write(json)
+}
+
+func (s *Server) HttpDeleteSession(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	sessionUuid := ctx.UserValue("uuid")
+	if sessionUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	session := &Token{}
+	err = s.Db.Model(session).Where("uuid = ?", sessionUuid).Where("user_uuid = ?", userUuid).Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusNotFound)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	err = s.RevokeToken(session)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// UPLOAD_TTL is how long an upload can be resumed after its last chunk.
+	UPLOAD_TTL             = 24 * time.Hour
+	UPLOAD_NAME_MAX_LENGTH = 255
+)
+
+var checksumRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Upload is a file being uploaded in chunks. Chunks are stored as separate
+// blobs until the upload is finalized, the file only exists from then on.
+type Upload struct {
+	Uuid     string `json:"uuid"`
+	UserUuid string `json:"-"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	// Checksum is the sha256 of the whole file given by the client, the
+	// upload can't be finalized if the content doesn't match.
+	Checksum string `json:"checksum"`
+	Offset   int64  `json:"offset"`
+	// Chunks are the names of the chunk blobs in order.
+	Chunks  []string  `json:"-"`
+	Expires time.Time `json:"expires"`
+	// Finalizing is set while the chunks are assembled, the upload can't be
+	// finalized or aborted meanwhile.
+	Finalizing bool `json:"finalizing"`
+}
+
+func uploadChunkKey(uploadUuid string, chunk string) string {
+	return blobKey("uploads", uploadUuid+"/"+chunk)
+}
+
+// chunksReader reads the chunks of an upload one after the other, opening
+// each only once the previous one was read.
+type chunksReader struct {
+	storage Storage
+	upload  *Upload
+	next    int
+	current io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= len(r.upload.Chunks) {
+				return 0, io.EOF
+			}
+			chunk, err := r.storage.Get(uploadChunkKey(r.upload.Uuid, r.upload.Chunks[r.next]), 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.current = chunk
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+func (server *Server) CreateUpload(userUuid string, name string, fileType string, size int64, checksum string) (*Upload, error) {
+	err := server.Authorize(userUuid, "", PERMISSION_UPLOAD_FILES)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 0 || !utf8.ValidString(name) || utf8.RuneCountInString(name) > UPLOAD_NAME_MAX_LENGTH {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "name must be 1 to %d characters", UPLOAD_NAME_MAX_LENGTH)
+	}
+	if size <= 0 || size > server.MaxFileSize {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "size must be between 1 and %d bytes", server.MaxFileSize)
+	}
+	if !checksumRegexp.MatchString(checksum) {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "checksum must be the hex encoded sha256 of the file")
+	}
+
+	upload := &Upload{
+		Uuid:     uuid.New().String(),
+		UserUuid: userUuid,
+		Name:     name,
+		Type:     fileType,
+		Size:     size,
+		Checksum: checksum,
+		Chunks:   []string{},
+		Expires:  time.Now().Add(UPLOAD_TTL),
+	}
+	_, err = server.Db.Model(upload).Insert()
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (server *Server) GetUpload(userUuid string, uploadUuid string) (*Upload, error) {
+	upload := &Upload{
+		Uuid: uploadUuid,
+	}
+	err := server.Db.Model(upload).WherePK().Where("user_uuid = ?", userUuid).Where("expires > now()").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, NewPacketError(ERROR_CODE_NOT_FOUND, "unknown upload %s", uploadUuid)
+		}
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AppendUpload streams a chunk of length bytes to storage at the offset,
+// which must be the current offset of the upload. A chunk sent again after a
+// dropped connection is rejected with the offset the upload actually reached.
+func (server *Server) AppendUpload(userUuid string, uploadUuid string, offset int64, r io.Reader, length int64) (*Upload, error) {
+	if length <= 0 {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "chunks must have a Content-Length")
+	}
+
+	upload, err := server.GetUpload(userUuid, uploadUuid)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return nil, NewPacketError(ERROR_CODE_CONFLICT, "upload is at offset %d", upload.Offset)
+	}
+	if offset+length > upload.Size {
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "chunk goes past the size of the upload")
+	}
+
+	// Concurrent appends at the same offset write different blobs, only the
+	// one committed first is kept.
+	chunk := strconv.FormatInt(offset, 10) + "-" + uuid.New().String()
+	err = server.Storage.Put(uploadChunkKey(uploadUuid, chunk), r, length, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		upload = &Upload{
+			Uuid: uploadUuid,
+		}
+		err := tx.Model(upload).WherePK().Where("user_uuid = ?", userUuid).Where("expires > now()").For("UPDATE").Select()
+		if err != nil {
+			if err == pg.ErrNoRows {
+				return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown upload %s", uploadUuid)
+			}
+			return err
+		}
+		if offset != upload.Offset {
+			return NewPacketError(ERROR_CODE_CONFLICT, "upload is at offset %d", upload.Offset)
+		}
+
+		upload.Offset += length
+		upload.Chunks = append(upload.Chunks, chunk)
+		upload.Expires = time.Now().Add(UPLOAD_TTL)
+		_, err = tx.Model(upload).WherePK().Column("offset", "chunks", "expires").Update()
+		return err
+	})
+	if err != nil {
+		server.Storage.Delete(uploadChunkKey(uploadUuid, chunk))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// FinalizeUpload assembles the chunks into a file once the whole content was
+// received and matches the checksum. The file keeps the uuid of the upload.
+// The upload is only locked to be marked as finalizing, the chunks are
+// assembled outside of any transaction.
+func (server *Server) FinalizeUpload(userUuid string, uploadUuid string) (*File, error) {
+	var upload *Upload
+	err := server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		upload = &Upload{
+			Uuid: uploadUuid,
+		}
+		err := tx.Model(upload).WherePK().Where("user_uuid = ?", userUuid).Where("expires > now()").For("UPDATE").Select()
+		if err != nil {
+			if err == pg.ErrNoRows {
+				return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown upload %s", uploadUuid)
+			}
+			return err
+		}
+		if upload.Finalizing {
+			return NewPacketError(ERROR_CODE_CONFLICT, "upload is being finalized")
+		}
+		if upload.Offset != upload.Size {
+			return NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "upload is incomplete, %d bytes out of %d", upload.Offset, upload.Size)
+		}
+
+		upload.Finalizing = true
+		_, err = tx.Model(upload).WherePK().Column("finalizing").Update()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok, err := server.assembleUpload(upload)
+	if err != nil {
+		// Storage errors may be temporary, the upload can be finalized again.
+		server.cancelFinalizing(upload)
+		return nil, err
+	}
+	if !ok {
+		// The chunks can't be trusted once the content doesn't match, the
+		// whole file has to be sent again.
+		err = server.deleteUpload(upload)
+		if err != nil {
+			log.Print(err)
+		}
+		return nil, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "checksum mismatch, the upload was discarded")
+	}
+
+	file := &File{
+		Uuid:     upload.Uuid,
+		UserUuid: upload.UserUuid,
+		Name:     upload.Name,
+		Type:     upload.Type,
+		Size:     upload.Size,
+		Hash:     hash,
+	}
+	err = server.Db.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		_, err := tx.Model(file).Insert()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Model(upload).WherePK().Delete()
+		return err
+	})
+	if err != nil {
+		// The file doesn't exist without its row, even when only the commit
+		// failed.
+		server.Storage.Delete(blobKey("files", upload.Uuid))
+		server.cancelFinalizing(upload)
+		return nil, err
+	}
+
+	for _, chunk := range upload.Chunks {
+		err = server.Storage.Delete(uploadChunkKey(upload.Uuid, chunk))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return file, nil
+}
+
+// cancelFinalizing lets the upload be finalized again after a failure.
+func (server *Server) cancelFinalizing(upload *Upload) {
+	_, err := server.Db.Model(upload).WherePK().Set("finalizing = false").Update()
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// assembleUpload writes the chunks of the upload to the blob of the file,
+// which is removed again when the content doesn't match the checksum.
+func (server *Server) assembleUpload(upload *Upload) (hash string, ok bool, err error) {
+	chunks := &chunksReader{
+		storage: server.Storage,
+		upload:  upload,
+	}
+	hash, err = server.PutBlob("files", upload.Uuid, chunks, upload.Size, upload.Type)
+	chunks.Close()
+	if err != nil {
+		return "", false, err
+	}
+	if hash != upload.Checksum {
+		server.Storage.Delete(blobKey("files", upload.Uuid))
+		return "", false, nil
+	}
+	return hash, true, nil
+}
+
+func (server *Server) AbortUpload(userUuid string, uploadUuid string) error {
+	upload, err := server.GetUpload(userUuid, uploadUuid)
+	if err != nil {
+		return err
+	}
+	// The chunks are being read, and will be deleted once the file exists.
+	if upload.Finalizing {
+		return NewPacketError(ERROR_CODE_CONFLICT, "upload is being finalized")
+	}
+	return server.deleteUpload(upload)
+}
+
+func (server *Server) deleteUpload(upload *Upload) error {
+	for _, chunk := range upload.Chunks {
+		err := server.Storage.Delete(uploadChunkKey(upload.Uuid, chunk))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := server.Db.Model(upload).WherePK().Delete()
+	return err
+}
+
+func (server *Server) PurgeExpiredUploads() {
+	for {
+		var uploads []Upload
+		err := server.Db.Model(&uploads).Where("expires <= now()").Select()
+		if err != nil {
+			log.Print(err)
+		}
+		purged := 0
+		for i := range uploads {
+			err = server.deleteUpload(&uploads[i])
+			if err != nil {
+				log.Print(err)
+			} else {
+				purged++
+			}
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired upload(s)", purged)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (s *Server) HttpPostUpload(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	size, err := strconv.ParseInt(string(ctx.FormValue("size")), 10, 64)
+	if err != nil {
+		HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "size must be an integer"))
+		return
+	}
+
+	upload, err := s.CreateUpload(userUuid, string(ctx.FormValue("name")), string(ctx.FormValue("type")), size, string(ctx.FormValue("checksum")))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	s.httpWriteUpload(ctx, upload)
+}
+
+func (s *Server) HttpGetUpload(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	uploadUuid := ctx.UserValue("uuid")
+	if uploadUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	upload, err := s.GetUpload(userUuid, uploadUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	s.httpWriteUpload(ctx, upload)
+}
+
+// HttpPatchUpload appends the request body to the upload at the offset given
+// by the Upload-Offset header. The body is streamed to storage, it isn't
+// bound by the request body limit.
+func (s *Server) HttpPatchUpload(ctx *fasthttp.RequestCtx) {
+	// Errors are sent without reading the chunk, which is left on the
+	// connection so it can't be reused.
+	defer func() {
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			ctx.SetConnectionClose()
+		}
+	}()
+
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	uploadUuid := ctx.UserValue("uuid")
+	if uploadUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	offset, err := strconv.ParseInt(string(ctx.Request.Header.Peek("Upload-Offset")), 10, 64)
+	if err != nil {
+		HttpError(ctx, NewPacketError(ERROR_CODE_INVALID_PAYLOAD, "Upload-Offset must be an integer"))
+		return
+	}
+
+	var body io.Reader = ctx.RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.PostBody())
+	}
+	upload, err := s.AppendUpload(userUuid, uploadUuid.(string), offset, body, int64(ctx.Request.Header.ContentLength()))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	s.httpWriteUpload(ctx, upload)
+}
+
+func (s *Server) HttpFinalizeUpload(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	uploadUuid := ctx.UserValue("uuid")
+	if uploadUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	file, err := s.FinalizeUpload(userUuid, uploadUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+
+	ctx.WriteString(file.Uuid)
+}
+
+func (s *Server) HttpDeleteUpload(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	userUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	uploadUuid := ctx.UserValue("uuid")
+	if uploadUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = s.AbortUpload(userUuid, uploadUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
+}
+
+// httpWriteUpload answers with the upload, its offset is also sent in the
+// Upload-Offset header.
+func (s *Server) httpWriteUpload(ctx *fasthttp.RequestCtx, upload *Upload) {
+	json, err := json.Marshal(upload)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
+	ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	ctx.Write(json)
+}
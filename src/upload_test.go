@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// newChunkedUpload stores the chunks of an upload whose checksum is the one
+// of content.
+func newChunkedUpload(t *testing.T, storage Storage, chunks []string, content string) *Upload {
+	sum := sha256.Sum256([]byte(content))
+	upload := &Upload{
+		Uuid:     "upload",
+		Type:     "text/plain",
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+	for i, chunk := range chunks {
+		name := strings.Repeat("c", i+1)
+		err := storage.Put(uploadChunkKey(upload.Uuid, name), strings.NewReader(chunk), int64(len(chunk)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload.Chunks = append(upload.Chunks, name)
+		upload.Size += int64(len(chunk))
+	}
+	upload.Offset = upload.Size
+	return upload
+}
+
+func TestAssembleUpload(t *testing.T) {
+	storage := newLocalStorage(t)
+	server := &Server{Storage: storage}
+	upload := newChunkedUpload(t, storage, []string{"hello", " ", "world"}, "hello world")
+
+	hash, ok, err := server.assembleUpload(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || hash != upload.Checksum {
+		t.Fatalf("got %s, %v, want the checksum %s", hash, ok, upload.Checksum)
+	}
+	blob, err := storage.Get(blobKey("files", upload.Uuid), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, _ := ioutil.ReadAll(blob)
+	if string(content) != "hello world" {
+		t.Errorf("file content = %q", content)
+	}
+}
+
+func TestAssembleUploadChecksumMismatch(t *testing.T) {
+	storage := newLocalStorage(t)
+	server := &Server{Storage: storage}
+	upload := newChunkedUpload(t, storage, []string{"hello", " ", "world"}, "hello there")
+
+	_, ok, err := server.assembleUpload(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("content accepted despite the checksum mismatch")
+	}
+	_, err = storage.Get(blobKey("files", upload.Uuid), 0, -1)
+	if err != ErrBlobNotFound {
+		t.Errorf("the mismatching file was kept: %v", err)
+	}
+}
+
+func TestAssembleUploadMissingChunk(t *testing.T) {
+	storage := newLocalStorage(t)
+	server := &Server{Storage: storage}
+	upload := newChunkedUpload(t, storage, []string{"hello", " ", "world"}, "hello world")
+	storage.Delete(uploadChunkKey(upload.Uuid, upload.Chunks[1]))
+
+	_, _, err := server.assembleUpload(upload)
+	if err == nil {
+		t.Fatal("assembled an upload with a missing chunk")
+	}
+	_, err = storage.Get(blobKey("files", upload.Uuid), 0, -1)
+	if err != ErrBlobNotFound {
+		t.Errorf("a partial file was kept: %v", err)
+	}
+}
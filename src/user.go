@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"log"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
@@ -9,20 +11,27 @@ import (
 )
 
 type User struct {
-	Uuid        string `json:"uuid"`
-	Login       string `json:"login"`
-	Password    string `json:"-"`
-	Online      bool   `json:"online"`
-	ChannelUuid string `json:"-"`
-	Nickname    string `json:"nickname"`
-	AvatarUuid  string `json:"avatarUuid"`
-	Bio         string `json:"bio"`
+	Uuid                string     `json:"uuid"`
+	Login               string     `json:"login"`
+	Password            string     `json:"-"`
+	Online              bool       `json:"online"`
+	ChannelUuid         string     `json:"-"`
+	Nickname            string     `json:"nickname"`
+	AvatarUuid          string     `json:"avatarUuid"`
+	Bio                 string     `json:"bio"`
+	Status              UserStatus `json:"-"`
+	CustomStatus        string     `json:"-"`
+	CustomStatusEmoji   string     `json:"-"`
+	CustomStatusExpires time.Time  `json:"-"`
+	Banned              bool       `json:"banned"`
+	Presence            *Presence  `pg:"-" json:"presence,omitempty"`
+	RoleUuids           []string   `pg:"-" json:"roleUuids"`
 }
 
 func (s *Server) HttpGetUsers(ctx *fasthttp.RequestCtx) {
 	token := string(ctx.Request.Header.Peek("token"))
 
-	_, err := s.GetUserUuidByToken(token)
+	userUuid, err := s.GetUserUuidByToken(token)
 	if err != nil {
 		if err == pg.ErrNoRows {
 			ctx.Error("", fasthttp.StatusUnauthorized)
@@ -39,6 +48,17 @@ func (s *Server) HttpGetUsers(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	presences := s.Hub.GetPresences(userUuid)
+	for i := range users {
+		presence, ok := presences[users[i].Uuid]
+		if !ok {
+			presence = OfflinePresence(users[i].Uuid)
+		}
+		users[i].Online = presence.IsOnline()
+		users[i].Presence = &presence
+		users[i].RoleUuids = s.GetUserRoleUuids(users[i].Uuid)
+	}
+
 	json, err := json.Marshal(users)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
@@ -57,10 +77,13 @@ func (s *Server) HttpUserLogin(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	var uuid string
-	_, err := s.Db.QueryOne(pg.Scan(&uuid), "SELECT uuid FROM users WHERE login ILIKE ? and password = ?", login, hashPassword(password))
+	var user User
+	err := s.Db.Model(&user).Where("lower(login) = lower(?)", login).Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
+			// Burn the same amount of time as a real verification so logins
+			// can't be enumerated by response time.
+			s.PasswordHasher.Hash(password)
 			ctx.Error("", fasthttp.StatusUnauthorized)
 		} else {
 			HttpInternalServerError(ctx, err)
@@ -68,11 +91,31 @@ func (s *Server) HttpUserLogin(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	token := &Token{
-		Token:    randomHash(),
-		UserUuid: uuid,
+	ok, rehash, err := verifyPassword(s.PasswordHasher, password, user.Password)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+	if !ok {
+		ctx.Error("", fasthttp.StatusUnauthorized)
+		return
+	}
+	if user.Banned {
+		ctx.Error("", fasthttp.StatusForbidden)
+		return
+	}
+
+	if rehash {
+		user.Password, err = s.PasswordHasher.Hash(password)
+		if err == nil {
+			_, err = s.Db.Model(&user).WherePK().Column("password").Update()
+		}
+		if err != nil {
+			log.Print("password rehash: ", err)
+		}
 	}
-	_, err = s.Db.Model(token).Insert()
+
+	token, err := s.CreateToken(ctx, user.Uuid)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -92,7 +135,7 @@ func (s *Server) HttpUserRegister(ctx *fasthttp.RequestCtx) {
 
 	var exists bool
 
-	_, err := s.Db.QueryOne(pg.Scan(&exists), "SELECT EXISTS(SELECT 1 FROM users WHERE login = ?)", login)
+	_, err := s.Db.QueryOne(pg.Scan(&exists), "SELECT EXISTS(SELECT 1 FROM users WHERE lower(login) = lower(?))", login)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -103,10 +146,16 @@ func (s *Server) HttpUserRegister(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	hashedPassword, err := s.PasswordHasher.Hash(password)
+	if err != nil {
+		HttpInternalServerError(ctx, err)
+		return
+	}
+
 	user := User{
 		Uuid:     uuid.New().String(),
 		Login:    login,
-		Password: hashPassword(password),
+		Password: hashedPassword,
 	}
 
 	_, err = s.Db.Model(&user).Insert()
@@ -115,6 +164,12 @@ func (s *Server) HttpUserRegister(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	err = s.EnsureOwner(s.OwnerLogin)
+	if err != nil {
+		log.Print("owner: ", err)
+	}
+	user.RoleUuids = s.GetUserRoleUuids(user.Uuid)
+
 	go func() {
 		s.Hub.Broadcast <- Packet{
 			Type: PACKET_TYPE_ADD_USERS,
@@ -122,11 +177,7 @@ func (s *Server) HttpUserRegister(ctx *fasthttp.RequestCtx) {
 		}
 	}()
 
-	token := &Token{
-		Token:    randomHash(),
-		UserUuid: user.Uuid,
-	}
-	_, err = s.Db.Model(token).Insert()
+	token, err := s.CreateToken(ctx, user.Uuid)
 	if err != nil {
 		HttpInternalServerError(ctx, err)
 		return
@@ -158,9 +209,117 @@ func (s *Server) HttpUserProfile(ctx *fasthttp.RequestCtx) {
 	}
 
 	go func() {
-		s.Hub.Broadcast <- Packet{
-			Type: PACKET_TYPE_UPDATE_USERS,
-			Data: []User{*user},
+		s.Hub.UsersUpdate <- UsersPacket{
+			PACKET_TYPE_UPDATE_USERS,
+			[]User{*user},
+		}
+	}()
+}
+
+// KickUser revokes every session of the user and closes its connections,
+// banning also prevents it from logging in again until unbanned.
+func (server *Server) KickUser(actorUuid string, userUuid string, ban bool) error {
+	permission := PERMISSION_KICK_MEMBERS
+	if ban {
+		permission = PERMISSION_BAN_MEMBERS
+	}
+	err := server.Authorize(actorUuid, "", permission)
+	if err != nil {
+		return err
+	}
+
+	server.Permissions.mux.RLock()
+	above := actorUuid == userUuid || server.Permissions.isOwner(userUuid) ||
+		(!server.Permissions.isOwner(actorUuid) && server.Permissions.highestPosition(userUuid) >= server.Permissions.highestPosition(actorUuid))
+	server.Permissions.mux.RUnlock()
+	if above {
+		return NewPacketError(ERROR_CODE_FORBIDDEN, "user is above your highest role")
+	}
+
+	user := &User{
+		Uuid:   userUuid,
+		Banned: ban,
+	}
+	exists, err := server.Db.Model(user).WherePK().Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown user %s", userUuid)
+	}
+	if ban {
+		_, err = server.Db.Model(user).WherePK().Column("banned").Update()
+		if err != nil {
+			return err
 		}
+	}
+
+	_, err = server.Db.Exec("DELETE FROM tokens WHERE user_uuid = ?", userUuid)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		server.Hub.Disconnect <- userUuid
 	}()
+
+	return nil
+}
+
+func (server *Server) UnbanUser(actorUuid string, userUuid string) error {
+	err := server.Authorize(actorUuid, "", PERMISSION_BAN_MEMBERS)
+	if err != nil {
+		return err
+	}
+
+	r, err := server.Db.Model(&User{Uuid: userUuid}).WherePK().Set("banned = false").Update()
+	if err != nil {
+		return err
+	}
+	if r.RowsAffected() == 0 {
+		return NewPacketError(ERROR_CODE_NOT_FOUND, "unknown user %s", userUuid)
+	}
+	return nil
+}
+
+func (s *Server) HttpKickUser(ctx *fasthttp.RequestCtx) {
+	s.httpModerateUser(ctx, func(actorUuid string, userUuid string) error {
+		return s.KickUser(actorUuid, userUuid, false)
+	})
+}
+
+func (s *Server) HttpBanUser(ctx *fasthttp.RequestCtx) {
+	s.httpModerateUser(ctx, func(actorUuid string, userUuid string) error {
+		return s.KickUser(actorUuid, userUuid, true)
+	})
+}
+
+func (s *Server) HttpUnbanUser(ctx *fasthttp.RequestCtx) {
+	s.httpModerateUser(ctx, s.UnbanUser)
+}
+
+func (s *Server) httpModerateUser(ctx *fasthttp.RequestCtx, moderate func(actorUuid string, userUuid string) error) {
+	token := string(ctx.Request.Header.Peek("token"))
+
+	actorUuid, err := s.GetUserUuidByToken(token)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			ctx.Error("", fasthttp.StatusUnauthorized)
+		} else {
+			HttpInternalServerError(ctx, err)
+		}
+		return
+	}
+
+	userUuid := ctx.UserValue("uuid")
+	if userUuid == nil {
+		ctx.Error("", fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = moderate(actorUuid, userUuid.(string))
+	if err != nil {
+		HttpError(ctx, err)
+		return
+	}
 }
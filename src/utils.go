@@ -1,23 +1,26 @@
 package main
 
-import (
-	"math/rand"
-	"time"
-)
-
 func panicIf(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
-var randomAlphabet = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+")
+func removeString(values []string, value string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
 
-func randomString(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = randomAlphabet[rand.Intn(len(randomAlphabet))]
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	return string(b)
+	return false
 }